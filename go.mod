@@ -5,6 +5,6 @@ go 1.14
 require (
 	github.com/coinbase/rosetta-sdk-go v0.6.7
 	github.com/dgraph-io/badger v1.6.1
-	gitlab.com/NebulousLabs/Sia v1.5.1-0.20200817133801-9643b1162016
+	gitlab.com/NebulousLabs/Sia v1.5.4
 	gitlab.com/NebulousLabs/encoding v0.0.0-20200604091946-456c3dc907fe
 )
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -18,25 +19,40 @@ import (
 	"gitlab.com/NebulousLabs/Sia/modules/consensus"
 	"gitlab.com/NebulousLabs/Sia/modules/gateway"
 	"gitlab.com/NebulousLabs/Sia/modules/transactionpool"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/rosetta-sia/service"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		reindex(os.Args[2:])
+		return
+	}
+
 	serverAddr := flag.String("a", ":8080", "address that the API listens on")
 	rpcAddr := flag.String("rpc-addr", ":9381", "address that the gateway listens on")
 	dir := flag.String("d", "data", "directory where node state is stored")
+	expectNetwork := flag.String("expect-network", "", "if set, refuse to start unless the binary was built for this network (Mainnet or Devnet)")
+	offline := flag.Bool("offline", false, "serve only the offline Construction API endpoints, without running a node")
+	pruneDepth := flag.Uint64("prune-depth", service.DefaultPruneDepth, "number of blocks after which spent outputs and confirmed submissions are pruned from the database")
 	flag.Parse()
 
-	n := &rtypes.NetworkIdentifier{
-		Blockchain: "Sia",
-		Network:    "Mainnet",
-	}
-	rs, shutdown, err := startNode(n, *dir, *rpcAddr)
+	n, err := service.NetworkIdentifier(*expectNetwork)
 	if err != nil {
 		log.Fatal(err)
 	}
-	supportedOps := []string{"Transfer"}
-	historicalBalanceLookup := false
+	var rs *service.RosettaService
+	var shutdown func() error
+	if *offline {
+		rs, shutdown = service.NewOffline(n), func() error { return nil }
+	} else {
+		rs, shutdown, err = startNode(n, *dir, *rpcAddr, stypes.BlockHeight(*pruneDepth))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	supportedOps := service.OperationTypes()
+	historicalBalanceLookup := true
 	a, err := asserter.NewServer(supportedOps, historicalBalanceLookup, []*rtypes.NetworkIdentifier{n}, nil, false)
 	if err != nil {
 		log.Fatal(err)
@@ -47,6 +63,10 @@ func main() {
 		server.NewMempoolAPIController(rs, a),
 		server.NewAccountAPIController(rs, a),
 		server.NewConstructionAPIController(rs, a),
+		server.NewSearchAPIController(rs, a),
+		server.NewEventsAPIController(rs, a),
+		service.NewHistoryAPIController(rs, a),
+		service.NewStatusAPIController(rs, a),
 	)
 	loggedRouter := server.LoggerMiddleware(router)
 	srv := &http.Server{
@@ -67,15 +87,71 @@ func main() {
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Println("ListenAndServe:", err)
 	}
+	// the service must be closed first, since it stops rebroadcasting and
+	// unsubscribes from the modules
+	if err := rs.Close(); err != nil {
+		log.Println("WARN: error shutting down service:", err)
+	}
 	if err := shutdown(); err != nil {
 		log.Println("WARN: error shutting down modules:", err)
 	}
-	if err := rs.Close(); err != nil {
-		log.Println("WARN: error shutting down service:", err)
+}
+
+// reindex implements the reindex subcommand, which rebuilds the service
+// database from the blocks stored by the local consensus set, without
+// connecting to any peers.
+func reindex(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	dir := fs.String("d", "data", "directory where node state is stored")
+	pruneDepth := fs.Uint64("prune-depth", service.DefaultPruneDepth, "number of blocks after which spent outputs are pruned from the database")
+	fs.Parse(args)
+
+	consensusDir := filepath.Join(*dir, "consensus")
+	if _, err := os.Stat(consensusDir); err != nil {
+		log.Fatalf("No consensus set found in %v: %v", consensusDir, err)
+	}
+	// the consensus set requires a gateway; use one without peers or
+	// persistent state
+	gatewayDir, err := ioutil.TempDir("", "rosetta-sia-gateway")
+	if err != nil {
+		log.Fatal(err)
+	}
+	g, err := gateway.New("localhost:0", false, gatewayDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs, errChan := consensus.New(g, false, consensusDir)
+	if err := handleAsyncErr(errChan); err != nil {
+		log.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt)
+		<-sigChan
+		fmt.Println("\rReceived interrupt, stopping reindex...")
+		close(cancel)
+	}()
+	err = service.Reindex(cs, filepath.Join(*dir, "db"), stypes.BlockHeight(*pruneDepth), cancel)
+	if err := cs.Close(); err != nil {
+		log.Println("WARN: error shutting down consensus set:", err)
+	}
+	if err := g.Close(); err != nil {
+		log.Println("WARN: error shutting down gateway:", err)
+	}
+	os.RemoveAll(gatewayDir)
+	select {
+	case <-cancel:
+		log.Fatal("Reindex interrupted; run the reindex command again to resume")
+	default:
+	}
+	if err != nil {
+		log.Fatal("Reindex failed:", err)
 	}
 }
 
-func startNode(network *rtypes.NetworkIdentifier, dir string, rpcAddr string) (*service.RosettaService, func() error, error) {
+func startNode(network *rtypes.NetworkIdentifier, dir string, rpcAddr string, pruneDepth stypes.BlockHeight) (*service.RosettaService, func() error, error) {
 	g, err := gateway.New(rpcAddr, true, filepath.Join(dir, "gateway"))
 	if err != nil {
 		return nil, nil, err
@@ -90,7 +166,7 @@ func startNode(network *rtypes.NetworkIdentifier, dir string, rpcAddr string) (*
 		return nil, nil, err
 	}
 
-	rs, err := service.New(network, g, cs, tp, filepath.Join(dir, "db"))
+	rs, err := service.New(network, g, cs, tp, filepath.Join(dir, "db"), pruneDepth)
 	if err != nil {
 		return nil, nil, err
 	}
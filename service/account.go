@@ -2,84 +2,403 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/dgraph-io/badger"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 )
 
-type balanceUTXO struct {
-	ID       string             `json:"id"`
-	Value    string             `json:"value"`
-	Timelock stypes.BlockHeight `json:"timelock"`
+// parseAccount parses the address of an account. In addition to standard
+// addresses, the synthetic accounts of file contracts are identified by their
+// contract ID, miner fees are paid to a synthetic account named "miner_fees",
+// and the siafund tax is paid to a synthetic account named "siafund_pool".
+// Synthetic accounts do not control any UTXOs.
+func parseAccount(addr string) (uh stypes.UnlockHash, synthetic bool, err error) {
+	if addr == minerFeesAddress {
+		return minerFeesAccount, true, nil
+	} else if addr == siafundPoolAddress {
+		return siafundPoolAccount, true, nil
+	} else if err = uh.LoadString(addr); err != nil {
+		var fcid crypto.Hash
+		if fcid.LoadString(addr) != nil {
+			return stypes.UnlockHash{}, false, err
+		}
+		return contractAccount(stypes.FileContractID(fcid)), true, nil
+	}
+	return uh, false, nil
+}
+
+func balanceAmounts(bal dbBalance) []*rtypes.Amount {
+	return []*rtypes.Amount{
+		convertAmount(bal.Siacoins, true),
+		convertSiafundAmount(bal.Siafunds, true),
+	}
+}
+
+// Sub-accounts of a standard address. A siacoin output is "locked" until the
+// current height reaches its maturity height; all other outputs (including all
+// siafund outputs) are "spendable".
+const (
+	subAccountSpendable = "spendable"
+	subAccountLocked    = "locked"
+)
+
+// addressBalance is the current balance of a standard address.
+type addressBalance struct {
+	Spendable stypes.Currency
+	Locked    stypes.Currency
+	Siafunds  stypes.Currency
+}
+
+func (ab addressBalance) amounts(subAccount *rtypes.SubAccountIdentifier) []*rtypes.Amount {
+	if subAccount == nil {
+		return []*rtypes.Amount{
+			convertAmount(ab.Spendable.Add(ab.Locked), true),
+			convertSiafundAmount(ab.Siafunds, true),
+		}
+	} else if subAccount.Address == subAccountLocked {
+		return []*rtypes.Amount{
+			convertAmount(ab.Locked, true),
+			convertSiafundAmount(stypes.ZeroCurrency, true),
+		}
+	}
+	return []*rtypes.Amount{
+		convertAmount(ab.Spendable, true),
+		convertSiafundAmount(ab.Siafunds, true),
+	}
 }
 
-func (rs *RosettaService) balance(addr stypes.UnlockHash) (*rtypes.Amount, []*rtypes.Coin, *rtypes.BlockIdentifier, *rtypes.Error) {
-	var balance stypes.Currency
-	var utxos []*rtypes.Coin
+// balance returns the current balance of addr, along with the balance that
+// would result if the unconfirmed transactions in uo were confirmed. Both are
+// derived from the totals of addr, adjusted by the outputs that uo spends and
+// creates, so their cost does not depend on the number of outputs addr
+// controls.
+func (rs *RosettaService) balance(addr stypes.UnlockHash, uo unconfirmedOutputs) (confirmed, pending addressBalance, bi *rtypes.BlockIdentifier, rerr *rtypes.Error) {
 	var height stypes.BlockHeight
 	var bid stypes.BlockID
 	err := rs.dbView(func(h *txnHelper) {
+		height = h.getCurrentHeight()
+		bid = h.getCurrentBlockID()
+
+		t := h.getAddressTotals(addr)
+		confirmed.Siafunds = t.Siafunds
 		if addr == (stypes.UnlockHash{}) {
-			balance = h.getVoidBalance()
-			return
-		}
-		var ids []stypes.SiacoinOutputID
-		h.get(keyAddress(addr), &ids)
-		for _, id := range ids {
-			utxo := h.getUTXO(id)
-			balance = balance.Add(utxo.Value)
-			utxos = append(utxos, &rtypes.Coin{
-				CoinIdentifier: &rtypes.CoinIdentifier{
-					Identifier: id.String(),
-				},
-				Amount: convertAmount(utxo.Value, true),
-				// TODO: include timelock somewhere
-			})
+			confirmed.Spendable = h.getVoidBalance()
+		} else {
+			confirmed.Spendable = t.Siacoins.Sub(t.LockedSiacoins)
+			confirmed.Locked = t.LockedSiacoins
+		}
+
+		pending = confirmed
+		for id := range uo.spent {
+			if h.isUnspent(addr, stypes.SiacoinOutputID(id)) {
+				utxo := h.getUTXO(stypes.SiacoinOutputID(id))
+				if utxo.Timelock > height {
+					pending.Locked = pending.Locked.Sub(utxo.Value)
+				} else {
+					pending.Spendable = pending.Spendable.Sub(utxo.Value)
+				}
+			} else if h.isSiafundUnspent(addr, stypes.SiafundOutputID(id)) {
+				pending.Siafunds = pending.Siafunds.Sub(h.getSiafundUTXO(stypes.SiafundOutputID(id)))
+			}
+		}
+		// NOTE: the transaction pool is updated after the database, so uo may
+		// briefly contain outputs that have already been confirmed. Such
+		// outputs must not be counted twice.
+		for id, sco := range uo.siacoin {
+			if sco.UnlockHash == addr && addr != (stypes.UnlockHash{}) && !uo.spent[crypto.Hash(id)] && !h.isUnspent(addr, id) {
+				pending.Spendable = pending.Spendable.Add(sco.Value)
+			}
+		}
+		for id, sfo := range uo.siafund {
+			if sfo.UnlockHash == addr && !uo.spent[crypto.Hash(id)] && !h.isSiafundUnspent(addr, id) {
+				pending.Siafunds = pending.Siafunds.Add(sfo.Value)
+			}
+		}
+	})
+	if err != nil {
+		return addressBalance{}, addressBalance{}, nil, errDatabase(err)
+	}
+	return confirmed, pending, &rtypes.BlockIdentifier{
+		Index: int64(height),
+		Hash:  bid.String(),
+	}, nil
+}
+
+// addressCoins lists the coins controlled by a standard address.
+type addressCoins struct {
+	Coins []*rtypes.Coin
+	// maturity height of each coin, keyed by coin identifier
+	Maturities map[string]stypes.BlockHeight
+	// identifiers of coins created by unconfirmed transactions
+	Unconfirmed []string
+}
+
+// coins returns the coins currently controlled by addr. The effects of the
+// unconfirmed transactions in uo are applied: coins spent by uo are omitted,
+// and coins created by uo are included (with a maturity height of 0). To
+// obtain the confirmed coins, pass the zero value of unconfirmedOutputs.
+func (rs *RosettaService) coins(addr stypes.UnlockHash, uo unconfirmedOutputs) (*addressCoins, *rtypes.BlockIdentifier, *rtypes.Error) {
+	ac := &addressCoins{
+		Maturities: make(map[string]stypes.BlockHeight),
+	}
+	addCoin := func(id crypto.Hash, amount *rtypes.Amount, maturity stypes.BlockHeight) {
+		ac.Coins = append(ac.Coins, &rtypes.Coin{
+			CoinIdentifier: &rtypes.CoinIdentifier{
+				Identifier: id.String(),
+			},
+			Amount: amount,
+		})
+		ac.Maturities[id.String()] = maturity
+	}
+	var height stypes.BlockHeight
+	var bid stypes.BlockID
+	err := rs.dbView(func(h *txnHelper) {
+		height = h.getCurrentHeight()
+		bid = h.getCurrentBlockID()
+
+		// NOTE: the void address does not track its outputs
+		if addr != (stypes.UnlockHash{}) {
+			for _, id := range h.getAddressUTXOs(addr) {
+				if uo.spent[crypto.Hash(id)] {
+					continue
+				}
+				utxo := h.getUTXO(id)
+				addCoin(crypto.Hash(id), convertAmount(utxo.Value, true), utxo.Timelock)
+			}
+		}
+		for _, id := range h.getAddressSiafundUTXOs(addr) {
+			if uo.spent[crypto.Hash(id)] {
+				continue
+			}
+			addCoin(crypto.Hash(id), convertSiafundAmount(h.getSiafundUTXO(id), true), 0)
+		}
+	})
+	if err != nil {
+		return nil, nil, errDatabase(err)
+	}
+
+	// NOTE: as in balance, outputs that have already been confirmed must not
+	// be counted twice
+	unconfirmed := func(id crypto.Hash) bool {
+		_, confirmed := ac.Maturities[id.String()]
+		return !confirmed && !uo.spent[id]
+	}
+	for id, sco := range uo.siacoin {
+		if sco.UnlockHash == addr && addr != (stypes.UnlockHash{}) && unconfirmed(crypto.Hash(id)) {
+			addCoin(crypto.Hash(id), convertAmount(sco.Value, true), 0)
+			ac.Unconfirmed = append(ac.Unconfirmed, id.String())
+		}
+	}
+	for id, sfo := range uo.siafund {
+		if sfo.UnlockHash == addr && unconfirmed(crypto.Hash(id)) {
+			addCoin(crypto.Hash(id), convertSiafundAmount(sfo.Value, true), 0)
+			ac.Unconfirmed = append(ac.Unconfirmed, id.String())
+		}
+	}
+	sort.Strings(ac.Unconfirmed)
+
+	return ac, &rtypes.BlockIdentifier{
+		Index: int64(height),
+		Hash:  bid.String(),
+	}, nil
+}
+
+func (rs *RosettaService) historicalBalance(addr stypes.UnlockHash, pbi *rtypes.PartialBlockIdentifier) ([]*rtypes.Amount, *rtypes.BlockIdentifier, *rtypes.Error) {
+	var bid stypes.BlockID
+	var height stypes.BlockHeight
+	if pbi.Hash != nil {
+		if err := bid.LoadString(*pbi.Hash); err != nil {
+			return nil, nil, errInvalidBlockID(err)
+		}
+	} else {
+		b, ok := rs.cs.BlockAtHeight(stypes.BlockHeight(*pbi.Index))
+		if !ok {
+			return nil, nil, errUnknownBlock
 		}
+		bid = b.ID()
+	}
+	var bal dbBalance
+	err := rs.dbView(func(h *txnHelper) {
+		height = stypes.BlockHeight(h.getBlockInfo(bid).Height)
+		bal = h.getBalanceAt(addr, height)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, nil, errUnknownBlock
+	} else if err != nil {
+		return nil, nil, errDatabase(err)
+	} else if pbi.Index != nil && int64(height) != *pbi.Index {
+		return nil, nil, errUnknownBlock
+	}
+	return balanceAmounts(bal), &rtypes.BlockIdentifier{
+		Index: int64(height),
+		Hash:  bid.String(),
+	}, nil
+}
+
+// syntheticBalance returns the current balance of a synthetic account.
+func (rs *RosettaService) syntheticBalance(acct stypes.UnlockHash) ([]*rtypes.Amount, *rtypes.BlockIdentifier, *rtypes.Error) {
+	var bal dbBalance
+	var height stypes.BlockHeight
+	var bid stypes.BlockID
+	err := rs.dbView(func(h *txnHelper) {
 		height = h.getCurrentHeight()
 		bid = h.getCurrentBlockID()
+		bal = h.getBalanceAt(acct, height)
 	})
 	if err != nil {
-		return nil, nil, nil, errDatabase(err)
+		return nil, nil, errDatabase(err)
 	}
-	return convertAmount(balance, true), utxos, &rtypes.BlockIdentifier{
+	return balanceAmounts(bal), &rtypes.BlockIdentifier{
 		Index: int64(height),
 		Hash:  bid.String(),
 	}, nil
 }
 
-// AccountBalance implements the /account/balance endpoint.
+// filterAmounts returns the amounts whose currency appears in currencies. If
+// currencies is empty, all amounts are returned.
+func filterAmounts(amounts []*rtypes.Amount, currencies []*rtypes.Currency) []*rtypes.Amount {
+	if len(currencies) == 0 {
+		return amounts
+	}
+	var filtered []*rtypes.Amount
+	for _, a := range amounts {
+		for _, c := range currencies {
+			if rtypes.Hash(a.Currency) == rtypes.Hash(c) {
+				filtered = append(filtered, a)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// filterCoins returns the coins whose currency appears in currencies. If
+// currencies is empty, all coins are returned.
+func filterCoins(coins []*rtypes.Coin, currencies []*rtypes.Currency) []*rtypes.Coin {
+	if len(currencies) == 0 {
+		return coins
+	}
+	var filtered []*rtypes.Coin
+	for _, coin := range coins {
+		if len(filterAmounts([]*rtypes.Amount{coin.Amount}, currencies)) > 0 {
+			filtered = append(filtered, coin)
+		}
+	}
+	return filtered
+}
+
+// AccountBalance implements the /account/balance endpoint. The current balance
+// of a standard address may be split into "spendable" and "locked" amounts by
+// specifying the corresponding sub-account; if no sub-account is specified,
+// the total balance is returned, and the split is reported in the metadata,
+// along with the balance that would result if every transaction in the
+// transaction pool were confirmed.
 func (rs *RosettaService) AccountBalance(ctx context.Context, request *rtypes.AccountBalanceRequest) (*rtypes.AccountBalanceResponse, *rtypes.Error) {
-	var uh stypes.UnlockHash
-	if err := uh.LoadString(request.AccountIdentifier.Address); err != nil {
-		return nil, errInvalidAddress(err)
+	if rs.offline() {
+		return nil, errOffline
+	}
+	uh, synthetic, perr := parseAccount(request.AccountIdentifier.Address)
+	if perr != nil {
+		return nil, errInvalidAddress(perr)
+	}
+	historical := request.BlockIdentifier != nil && (request.BlockIdentifier.Index != nil || request.BlockIdentifier.Hash != nil)
+	if sa := request.AccountIdentifier.SubAccount; sa != nil {
+		if sa.Address != subAccountSpendable && sa.Address != subAccountLocked {
+			return nil, errInvalidSubAccount(fmt.Errorf("unknown sub-account %q", sa.Address))
+		} else if synthetic {
+			return nil, errInvalidSubAccount(errors.New("synthetic accounts do not have sub-accounts"))
+		} else if historical {
+			return nil, errInvalidSubAccount(errors.New("sub-account balances are only available for the current block"))
+		}
 	}
 
-	balance, _, bi, err := rs.balance(uh)
+	var balances []*rtypes.Amount
+	var bi *rtypes.BlockIdentifier
+	var md map[string]interface{}
+	var err *rtypes.Error
+	if historical {
+		balances, bi, err = rs.historicalBalance(uh, request.BlockIdentifier)
+	} else if synthetic {
+		balances, bi, err = rs.syntheticBalance(uh)
+	} else {
+		var confirmed, pending addressBalance
+		confirmed, pending, bi, err = rs.balance(uh, rs.unconfirmedOutputs())
+		if err == nil {
+			balances = confirmed.amounts(request.AccountIdentifier.SubAccount)
+			if request.AccountIdentifier.SubAccount == nil {
+				md = map[string]interface{}{
+					subAccountSpendable: confirmed.Spendable.String(),
+					subAccountLocked:    confirmed.Locked.String(),
+					"pending_siacoins":  pending.Spendable.Add(pending.Locked).String(),
+					"pending_siafunds":  pending.Siafunds.String(),
+				}
+			}
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &rtypes.AccountBalanceResponse{
 		BlockIdentifier: bi,
-		Balances:        []*rtypes.Amount{balance},
+		Balances:        filterAmounts(balances, request.Currencies),
+		Metadata:        md,
 	}, nil
 }
 
-// AccountCoins implements the /account/coins endpoint.
+// AccountCoins implements the /account/coins endpoint. Since Rosetta coins
+// cannot carry metadata, the maturity height of each coin is reported in the
+// response metadata, keyed by coin identifier. A coin is spendable once the
+// current height reaches its maturity height.
+//
+// If include_mempool is set, coins spent by transactions in the transaction
+// pool are omitted, and coins created by them are included; the identifiers of
+// the latter are reported in the "unconfirmed_coins" metadata field.
 func (rs *RosettaService) AccountCoins(ctx context.Context, request *rtypes.AccountCoinsRequest) (*rtypes.AccountCoinsResponse, *rtypes.Error) {
-	var uh stypes.UnlockHash
-	if err := uh.LoadString(request.AccountIdentifier.Address); err != nil {
-		return nil, errInvalidAddress(err)
+	if rs.offline() {
+		return nil, errOffline
+	}
+	// NOTE: synthetic accounts do not control any coins, so their coin lists
+	// will always be empty
+	uh, _, perr := parseAccount(request.AccountIdentifier.Address)
+	if perr != nil {
+		return nil, errInvalidAddress(perr)
 	}
 
-	_, coins, bi, err := rs.balance(uh)
+	var uo unconfirmedOutputs
+	if request.IncludeMempool {
+		uo = rs.unconfirmedOutputs()
+	}
+	ac, bi, err := rs.coins(uh, uo)
 	if err != nil {
 		return nil, err
 	}
 
+	coins := filterCoins(ac.Coins, request.Currencies)
+	maturities := make(map[string]interface{}, len(coins))
+	for _, c := range coins {
+		maturities[c.CoinIdentifier.Identifier] = ac.Maturities[c.CoinIdentifier.Identifier]
+	}
+	md := map[string]interface{}{
+		"maturity_heights": maturities,
+	}
+	if request.IncludeMempool {
+		unconfirmed := []string{}
+		for _, id := range ac.Unconfirmed {
+			if _, ok := maturities[id]; ok {
+				unconfirmed = append(unconfirmed, id)
+			}
+		}
+		md["unconfirmed_coins"] = unconfirmed
+	}
 	return &rtypes.AccountCoinsResponse{
 		BlockIdentifier: bi,
 		Coins:           coins,
+		Metadata:        md,
 	}, nil
 }
@@ -2,28 +2,98 @@ package service
 
 import (
 	"context"
+	"fmt"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"github.com/dgraph-io/badger"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 )
 
-func getInput(h *txnHelper, sci stypes.SiacoinInput) stypes.SiacoinOutput {
-	utxo := h.getUTXO(sci.ParentID)
+// inputValues maps the IDs of spent outputs to their values.
+type inputValues map[[32]byte]stypes.Currency
+
+func getInput(sci stypes.SiacoinInput, values inputValues, uo unconfirmedOutputs) (stypes.SiacoinOutput, bool) {
+	if sco, ok := uo.siacoin[sci.ParentID]; ok {
+		return sco, true
+	}
 	return stypes.SiacoinOutput{
 		UnlockHash: sci.UnlockConditions.UnlockHash(),
-		Value:      utxo.Value,
+		Value:      values[sci.ParentID],
+	}, false
+}
+
+func getSiafundInput(sfi stypes.SiafundInput, values inputValues, uo unconfirmedOutputs) (stypes.SiafundOutput, bool) {
+	if sfo, ok := uo.siafund[sfi.ParentID]; ok {
+		return sfo, true
 	}
+	return stypes.SiafundOutput{
+		UnlockHash: sfi.UnlockConditions.UnlockHash(),
+		Value:      values[sfi.ParentID],
+	}, false
+}
+
+// unconfirmedMetadata is attached to operations that spend an output created
+// by an unconfirmed transaction.
+func unconfirmedMetadata() map[string]interface{} {
+	return map[string]interface{}{"unconfirmed": true}
 }
 
-func convertTransaction(h *txnHelper, txn stypes.Transaction) *rtypes.Transaction {
+// convertTransaction converts a Sia transaction to a Rosetta transaction. The
+// values of its inputs are taken from values, unless they were created by one
+// of the transactions in uo, in which case their operations are marked as
+// unconfirmed.
+func convertTransaction(txn stypes.Transaction, values inputValues, uo unconfirmedOutputs) *rtypes.Transaction {
 	var ops []*rtypes.Operation
 	for _, sci := range txn.SiacoinInputs {
-		ops = append(ops, transferOp(len(ops), getInput(h, sci), sci.ParentID, false))
+		sco, unconfirmed := getInput(sci, values, uo)
+		op := transferOp(len(ops), sco, sci.ParentID, false)
+		if unconfirmed {
+			op.Metadata = unconfirmedMetadata()
+		}
+		ops = append(ops, op)
 	}
 	for i, sco := range txn.SiacoinOutputs {
 		ops = append(ops, transferOp(len(ops), sco, txn.SiacoinOutputID(uint64(i)), true))
 	}
+	for _, sfi := range txn.SiafundInputs {
+		sfo, unconfirmed := getSiafundInput(sfi, values, uo)
+		op := siafundTransferOp(len(ops), sfo, sfi.ParentID, false)
+		if unconfirmed {
+			op.Metadata = unconfirmedMetadata()
+		}
+		ops = append(ops, op)
+	}
+	for i, sfo := range txn.SiafundOutputs {
+		ops = append(ops, siafundTransferOp(len(ops), sfo, txn.SiafundOutputID(uint64(i)), true))
+	}
+	for i, fc := range txn.FileContracts {
+		value := contractValue(fc)
+		op := contractOp(len(ops), opTypeContractFormation, txn.FileContractID(uint64(i)), convertAmount(value, true))
+		op.Metadata = map[string]interface{}{
+			"window_start": fc.WindowStart,
+			"window_end":   fc.WindowEnd,
+		}
+		ops = append(ops, op)
+		taxOp := siafundPoolOp(len(ops), opTypeSiafundTax, contractTax(fc), true)
+		taxOp.RelatedOperations = []*rtypes.OperationIdentifier{op.OperationIdentifier}
+		ops = append(ops, taxOp)
+	}
+	for _, fcr := range txn.FileContractRevisions {
+		op := contractOp(len(ops), opTypeContractRevision, fcr.ParentID, nil)
+		op.Metadata = map[string]interface{}{
+			"revision_number": fcr.NewRevisionNumber,
+			"window_start":    fcr.NewWindowStart,
+			"window_end":      fcr.NewWindowEnd,
+		}
+		ops = append(ops, op)
+	}
+	for _, sp := range txn.StorageProofs {
+		ops = append(ops, contractOp(len(ops), opTypeStorageProof, sp.ParentID, nil))
+	}
+	if fees := totalFees(txn); !fees.IsZero() {
+		ops = append(ops, feeOp(len(ops), fees, true))
+	}
 	return &rtypes.Transaction{
 		TransactionIdentifier: &rtypes.TransactionIdentifier{
 			Hash: txn.ID().String(),
@@ -32,50 +102,129 @@ func convertTransaction(h *txnHelper, txn stypes.Transaction) *rtypes.Transactio
 	}
 }
 
-func (rs *RosettaService) convertBlock(b stypes.Block) (*rtypes.Block, *rtypes.Error) {
-	bid := b.ID()
-	var info blockInfo
-	var txns []*rtypes.Transaction
-	err := rs.dbView(func(h *txnHelper) {
-		info = h.getBlockInfo(bid)
-		for _, txn := range b.Transactions {
-			if rtxn := convertTransaction(h, txn); len(rtxn.Operations) > 0 {
-				txns = append(txns, rtxn)
+// convertBlockTransaction converts the transaction at the specified index
+// within b, whose inputs are valued using the outputs spent by b. Unlike
+// convertTransaction, the resulting fee operation (if any) is linked to the
+// payout transaction of b, which debits the miner fees account and pays the
+// fees out to the block's miner payouts. If the transaction contains the
+// Foundation address update applied by b, the corresponding operations are
+// appended.
+func convertBlockTransaction(b stypes.Block, info blockInfo, values inputValues, index uint64) *rtypes.Transaction {
+	rtxn := convertTransaction(b.Transactions[index], values, unconfirmedOutputs{})
+	for _, op := range rtxn.Operations {
+		if op.Type == opTypeFee {
+			op.Metadata = map[string]interface{}{
+				"payout_transaction": b.ID().String(),
 			}
 		}
-	})
-	if err == badger.ErrKeyNotFound {
-		return nil, errUnknownBlock
-	} else if err != nil {
-		return nil, errDatabase(err)
 	}
-	// add miner payouts and file contract conclusions
-	//
+	if fu := info.FoundationUpdate; fu != nil && fu.TxnIndex == index {
+		rtxn.Operations = append(rtxn.Operations, foundationUpdateOps(len(rtxn.Operations), fu)...)
+	}
+	return rtxn
+}
+
+// payoutTransaction returns a synthetic transaction containing the miner
+// payouts, Foundation subsidy, siafund claims, and file contract conclusions
+// created by the block.
+// Each resolved contract is debited the full value of the contract, which is
+// credited to the contract's valid or missed proof outputs. Likewise, the
+// miner fees account is debited by the total fees of the block; these fees
+// form part of the block reward, alongside the block subsidy, and the siafund
+// pool account is debited by the total siafund claims paid out by the block.
+func payoutTransaction(b stypes.Block, info blockInfo) *rtypes.Transaction {
+	bid := b.ID()
 	// NOTE: every block has at least one miner payout, so this slice is
 	// guaranteed to be non-empty
 	minerPayouts := make(map[stypes.SiacoinOutputID]struct{}, len(b.MinerPayouts))
 	for i := range b.MinerPayouts {
 		minerPayouts[b.MinerPayoutID(uint64(i))] = struct{}{}
 	}
+	claims := claimOutputIDs(b)
 	var blockOps []*rtypes.Operation
+	var related []*rtypes.OperationIdentifier
+	var fees stypes.Currency
+	for _, txn := range b.Transactions {
+		fees = fees.Add(totalFees(txn))
+	}
+	if !fees.IsZero() {
+		op := feeOp(len(blockOps), fees, false)
+		related = []*rtypes.OperationIdentifier{op.OperationIdentifier}
+		blockOps = append(blockOps, op)
+	}
+	var claimRelated []*rtypes.OperationIdentifier
+	if _, claimed := siafundPoolFlows(b, info); !claimed.IsZero() {
+		op := siafundPoolOp(len(blockOps), opTypeClaim, claimed, false)
+		claimRelated = []*rtypes.OperationIdentifier{op.OperationIdentifier}
+		blockOps = append(blockOps, op)
+	}
+	contractOutputs := make(map[stypes.SiacoinOutputID]*rtypes.Operation)
+	for _, rc := range info.ResolvedContracts {
+		op := contractOp(len(blockOps), opTypeContract, rc.ID, convertAmount(rc.Value, false))
+		op.Metadata = map[string]interface{}{
+			"valid": rc.Valid,
+		}
+		for _, id := range rc.outputIDs() {
+			contractOutputs[id] = op
+		}
+		blockOps = append(blockOps, op)
+	}
 	for _, do := range info.DelayedOutputs {
 		op := transferOp(len(blockOps), do.SiacoinOutput, do.ID, true)
 		if _, ok := minerPayouts[do.ID]; ok {
 			op.Type = opTypeBlock
+			op.RelatedOperations = related
+		} else if do.ID == bid.FoundationSubsidyID() {
+			op.Type = opTypeFoundationSubsidy
+		} else if _, ok := claims[do.ID]; ok {
+			op.Type = opTypeClaim
+			op.RelatedOperations = claimRelated
 		} else {
 			op.Type = opTypeContract
+			if debit, ok := contractOutputs[do.ID]; ok {
+				op.RelatedOperations = []*rtypes.OperationIdentifier{debit.OperationIdentifier}
+			}
 		}
 		op.Metadata = map[string]interface{}{
 			"timelock": info.Height + int64(stypes.MaturityDelay),
 		}
 		blockOps = append(blockOps, op)
 	}
-	txns = append(txns, &rtypes.Transaction{
+	return &rtypes.Transaction{
 		TransactionIdentifier: &rtypes.TransactionIdentifier{
 			Hash: bid.String(),
 		},
 		Operations: blockOps,
+	}
+}
+
+// blockTransaction converts the transaction at the specified index within b.
+func blockTransaction(b stypes.Block, info blockInfo, index uint64) *rtypes.Transaction {
+	if index == payoutTxnIndex {
+		return payoutTransaction(b, info)
+	}
+	return convertBlockTransaction(b, info, info.inputValues(), index)
+}
+
+func (rs *RosettaService) convertBlock(b stypes.Block) (*rtypes.Block, *rtypes.Error) {
+	bid := b.ID()
+	var info blockInfo
+	var txns []*rtypes.Transaction
+	err := rs.dbView(func(h *txnHelper) {
+		info = h.getBlockInfo(bid)
+		values := info.inputValues()
+		for i := range b.Transactions {
+			if rtxn := convertBlockTransaction(b, info, values, uint64(i)); len(rtxn.Operations) > 0 {
+				txns = append(txns, rtxn)
+			}
+		}
 	})
+	if err == badger.ErrKeyNotFound {
+		return nil, errUnknownBlock
+	} else if err != nil {
+		return nil, errDatabase(err)
+	}
+	txns = append(txns, payoutTransaction(b, info))
 
 	rb := &rtypes.Block{
 		BlockIdentifier: &rtypes.BlockIdentifier{
@@ -97,6 +246,9 @@ func (rs *RosettaService) convertBlock(b stypes.Block) (*rtypes.Block, *rtypes.E
 
 // Block implements the /block endpoint.
 func (rs *RosettaService) Block(ctx context.Context, request *rtypes.BlockRequest) (*rtypes.BlockResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
 	var block *rtypes.Block
 	var err *rtypes.Error
 	switch {
@@ -108,7 +260,7 @@ func (rs *RosettaService) Block(ctx context.Context, request *rtypes.BlockReques
 		block, err = rs.convertBlock(b)
 		// sanity check
 		if err == nil && block.BlockIdentifier.Index != *request.BlockIdentifier.Index {
-			panic("block height mismatch")
+			return nil, errDatabase(fmt.Errorf("block at height %v is recorded at height %v", *request.BlockIdentifier.Index, block.BlockIdentifier.Index))
 		}
 
 	case request.BlockIdentifier.Hash != nil:
@@ -121,10 +273,6 @@ func (rs *RosettaService) Block(ctx context.Context, request *rtypes.BlockReques
 			return nil, errUnknownBlock
 		}
 		block, err = rs.convertBlock(b)
-		// sanity check
-		if err == nil && block.BlockIdentifier.Hash != *request.BlockIdentifier.Hash {
-			panic("block hash mismatch")
-		}
 
 	default:
 		block, err = rs.convertBlock(rs.cs.CurrentBlock())
@@ -137,6 +285,35 @@ func (rs *RosettaService) Block(ctx context.Context, request *rtypes.BlockReques
 
 // BlockTransaction implements the /block/transaction endpoint.
 func (rs *RosettaService) BlockTransaction(ctx context.Context, request *rtypes.BlockTransactionRequest) (*rtypes.BlockTransactionResponse, *rtypes.Error) {
-	// all transactions are returned from /block
-	return nil, errNotImplemented
+	if rs.offline() {
+		return nil, errOffline
+	}
+	var bid stypes.BlockID
+	if err := bid.LoadString(request.BlockIdentifier.Hash); err != nil {
+		return nil, errInvalidBlockID(err)
+	}
+	var txid crypto.Hash
+	if err := txid.LoadString(request.TransactionIdentifier.Hash); err != nil {
+		return nil, errInvalidTxnID(err)
+	}
+	b, _, ok := rs.cs.BlockByID(bid)
+	if !ok {
+		return nil, errUnknownBlock
+	}
+	var rtxn *rtypes.Transaction
+	err := rs.dbView(func(h *txnHelper) {
+		loc := h.getTxnLocation(txid)
+		if h.err != nil || loc.BlockID != bid {
+			return
+		}
+		rtxn = blockTransaction(b, h.getBlockInfo(bid), loc.Index)
+	})
+	if err == badger.ErrKeyNotFound || (err == nil && rtxn == nil) {
+		return nil, errUnknownTxn
+	} else if err != nil {
+		return nil, errDatabase(err)
+	}
+	return &rtypes.BlockTransactionResponse{
+		Transaction: rtxn,
+	}, nil
 }
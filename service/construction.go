@@ -1,12 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -16,15 +18,95 @@ import (
 
 type constructionTxn struct {
 	stypes.Transaction
-	InputParents []stypes.SiacoinOutput
+	InputParents        []stypes.SiacoinOutput
+	SiafundInputParents []stypes.SiafundOutput
+	// unconfirmed transactions that must be submitted alongside Transaction
+	Parents []stypes.Transaction
+	// height at which the transaction is expected to be confirmed, or 0 if
+	// unknown
+	TargetHeight stypes.BlockHeight
+}
+
+// sigHash returns the hash signed by the ith signature of the transaction.
+// Since the signature hash depends on which hardforks are active, it is
+// computed at the target height of the transaction; if the target height is
+// unknown, every hardfork is assumed to be active.
+func (ct constructionTxn) sigHash(i int) crypto.Hash {
+	height := ct.TargetHeight
+	if height == 0 {
+		height = stypes.FoundationHardforkHeight + 1
+	}
+	return ct.SigHash(i, height)
+}
+
+// missingPayloads returns the signing payloads of the signatures that have not
+// yet been added to the transaction.
+func (ct constructionTxn) missingPayloads() []*rtypes.SigningPayload {
+	var missing []*rtypes.SigningPayload
+	for i, ts := range ct.TransactionSignatures {
+		if len(ts.Signature) == 0 {
+			sigHash := ct.sigHash(i)
+			pk, _ := signingKey(ct.Transaction, i)
+			missing = append(missing, &rtypes.SigningPayload{
+				AccountIdentifier: signerAccount(pk),
+				Bytes:             sigHash[:],
+				SignatureType:     rtypes.Ed25519,
+			})
+		}
+	}
+	return missing
 }
 
 func (ct constructionTxn) MarshalSia(w io.Writer) error {
-	return encoding.NewEncoder(w).EncodeAll(ct.Transaction, ct.InputParents)
+	e := encoding.NewEncoder(w)
+	if err := e.EncodeAll(ct.Transaction, ct.InputParents, ct.SiafundInputParents); err != nil {
+		return err
+	} else if len(ct.Parents) == 0 && ct.TargetHeight == 0 {
+		return nil
+	}
+	return e.EncodeAll(ct.Parents, ct.TargetHeight)
 }
 
 func (ct *constructionTxn) UnmarshalSia(r io.Reader) error {
-	return encoding.NewDecoder(r, encoding.DefaultAllocLimit).DecodeAll(&ct.Transaction, &ct.InputParents)
+	d := encoding.NewDecoder(r, encoding.DefaultAllocLimit)
+	if err := d.DecodeAll(&ct.Transaction, &ct.InputParents, &ct.SiafundInputParents); err != nil {
+		return err
+	}
+	// Parents and TargetHeight are optional
+	if err := d.DecodeAll(&ct.Parents, &ct.TargetHeight); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// orderTransactionSet orders txns such that each transaction follows the
+// transactions whose outputs it spends, removing any duplicates.
+func orderTransactionSet(txns []stypes.Transaction) []stypes.Transaction {
+	uo := newUnconfirmedOutputs(txns)
+	seen := make(map[stypes.TransactionID]bool)
+	ordered := make([]stypes.Transaction, 0, len(txns))
+	var visit func(txn stypes.Transaction)
+	visit = func(txn stypes.Transaction) {
+		if seen[txn.ID()] {
+			return
+		}
+		seen[txn.ID()] = true
+		for _, sci := range txn.SiacoinInputs {
+			if i, ok := uo.creator[crypto.Hash(sci.ParentID)]; ok {
+				visit(txns[i])
+			}
+		}
+		for _, sfi := range txn.SiafundInputs {
+			if i, ok := uo.creator[crypto.Hash(sfi.ParentID)]; ok {
+				visit(txns[i])
+			}
+		}
+		ordered = append(ordered, txn)
+	}
+	for _, txn := range txns {
+		visit(txn)
+	}
+	return ordered
 }
 
 func decodeTxn(b64 string) (txn constructionTxn, err error) {
@@ -32,46 +114,253 @@ func decodeTxn(b64 string) (txn constructionTxn, err error) {
 	if err == nil {
 		err = encoding.Unmarshal(b, &txn)
 	}
+	if err == nil {
+		err = txn.validate()
+	}
 	return
 }
 
-// ConstructionCombine implements the /construction/combine endpoint.
+// validate checks that a decoded transaction has the shape of one produced by
+// /construction/payloads, i.e. that it has a parent for each input and that
+// each of its signatures covers the whole transaction. Transactions that fail
+// these checks would otherwise cause parsing or sighash computation to panic.
+func (ct constructionTxn) validate() error {
+	if len(ct.InputParents) != len(ct.SiacoinInputs) {
+		return fmt.Errorf("transaction has %v siacoin inputs, but %v input parents", len(ct.SiacoinInputs), len(ct.InputParents))
+	} else if len(ct.SiafundInputParents) != len(ct.SiafundInputs) {
+		return fmt.Errorf("transaction has %v siafund inputs, but %v input parents", len(ct.SiafundInputs), len(ct.SiafundInputParents))
+	}
+	for i, ts := range ct.TransactionSignatures {
+		cf := ts.CoveredFields
+		partial := len(cf.SiacoinInputs) + len(cf.SiacoinOutputs) + len(cf.FileContracts) +
+			len(cf.FileContractRevisions) + len(cf.StorageProofs) + len(cf.SiafundInputs) +
+			len(cf.SiafundOutputs) + len(cf.MinerFees) + len(cf.ArbitraryData) + len(cf.TransactionSignatures)
+		if !cf.WholeTransaction || partial != 0 {
+			return fmt.Errorf("signature %v does not cover the whole transaction", i)
+		}
+	}
+	return nil
+}
+
+// standardUnlockConditions returns the unlock conditions of a standard
+// address, i.e. a single ed25519 key with no timelock.
+func standardUnlockConditions(key []byte) stypes.UnlockConditions {
+	return stypes.UnlockConditions{
+		PublicKeys: []stypes.SiaPublicKey{{
+			Algorithm: stypes.SignatureEd25519,
+			Key:       key,
+		}},
+		SignaturesRequired: 1,
+		Timelock:           0,
+	}
+}
+
+// signerAccount returns the account used to identify the holder of pk in
+// signing payloads and parse responses, namely the standard address of pk. For
+// inputs spent from standard addresses, this is the address of the input.
+func signerAccount(pk stypes.SiaPublicKey) *rtypes.AccountIdentifier {
+	return &rtypes.AccountIdentifier{
+		Address: standardUnlockConditions(pk.Key).UnlockHash().String(),
+	}
+}
+
+// decodeMetadata decodes the metadata field key into v, reporting whether the
+// field was present. Since metadata values may be arbitrary JSON (or, when
+// called directly, arbitrary Go values), they are decoded by round-tripping
+// through encoding/json.
+func decodeMetadata(md map[string]interface{}, key string, v interface{}) (bool, error) {
+	mv, ok := md[key]
+	if !ok {
+		return false, nil
+	}
+	js, err := json.Marshal(mv)
+	if err == nil {
+		err = json.Unmarshal(js, v)
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid %v: %v", key, err)
+	}
+	return true, nil
+}
+
+// inputUnlockConditions returns the unlock conditions of an input operation,
+// along with the indices of the keys that will sign it. The unlock conditions
+// are specified either as a single public key (for standard addresses) or in
+// full, using the JSON encoding of Sia's UnlockConditions type.
+func inputUnlockConditions(md map[string]interface{}) (uc stypes.UnlockConditions, keyIndices []uint64, err error) {
+	var hexKey string
+	if ok, err := decodeMetadata(md, "public_key", &hexKey); err != nil {
+		return stypes.UnlockConditions{}, nil, err
+	} else if ok {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return stypes.UnlockConditions{}, nil, err
+		}
+		uc = standardUnlockConditions(key)
+	} else if ok, err := decodeMetadata(md, "unlock_conditions", &uc); err != nil {
+		return stypes.UnlockConditions{}, nil, err
+	} else if !ok {
+		return stypes.UnlockConditions{}, nil, errors.New("missing public_key or unlock_conditions")
+	}
+
+	// by default, sign with the first SignaturesRequired keys
+	if ok, err := decodeMetadata(md, "public_key_indices", &keyIndices); err != nil {
+		return stypes.UnlockConditions{}, nil, err
+	} else if !ok {
+		for i := uint64(0); i < uc.SignaturesRequired; i++ {
+			keyIndices = append(keyIndices, i)
+		}
+	}
+	if uint64(len(keyIndices)) != uc.SignaturesRequired {
+		return stypes.UnlockConditions{}, nil, fmt.Errorf("unlock conditions require %v signatures, but %v keys were specified", uc.SignaturesRequired, len(keyIndices))
+	}
+	seen := make(map[uint64]bool)
+	for _, i := range keyIndices {
+		if i >= uint64(len(uc.PublicKeys)) {
+			return stypes.UnlockConditions{}, nil, fmt.Errorf("key index %v out of range", i)
+		} else if seen[i] {
+			return stypes.UnlockConditions{}, nil, fmt.Errorf("duplicate key index %v", i)
+		} else if uc.PublicKeys[i].Algorithm != stypes.SignatureEd25519 {
+			return stypes.UnlockConditions{}, nil, fmt.Errorf("key %v is not an ed25519 key", i)
+		}
+		seen[i] = true
+	}
+	return uc, keyIndices, nil
+}
+
+// signingKey returns the public key that must produce the signature at index
+// i of txn.
+func signingKey(txn stypes.Transaction, i int) (stypes.SiaPublicKey, bool) {
+	ts := txn.TransactionSignatures[i]
+	var uc stypes.UnlockConditions
+	var found bool
+	for _, in := range txn.SiacoinInputs {
+		if crypto.Hash(in.ParentID) == ts.ParentID {
+			uc, found = in.UnlockConditions, true
+		}
+	}
+	for _, in := range txn.SiafundInputs {
+		if crypto.Hash(in.ParentID) == ts.ParentID {
+			uc, found = in.UnlockConditions, true
+		}
+	}
+	if !found || ts.PublicKeyIndex >= uint64(len(uc.PublicKeys)) {
+		return stypes.SiaPublicKey{}, false
+	}
+	return uc.PublicKeys[ts.PublicKeyIndex], true
+}
+
+// ConstructionCombine implements the /construction/combine endpoint. Each
+// signature is verified against the key specified by the transaction, and
+// signatures for unknown payloads (or duplicate signatures) are rejected.
+//
+// Signatures may be combined incrementally, e.g. when the keys of a multisig
+// address are held by different parties: the returned transaction may be
+// passed back to /construction/combine (as the unsigned transaction) along with
+// further signatures. The payloads that have not yet been signed are reported
+// by /construction/parse, and /construction/submit rejects the transaction
+// until every signature is present.
 func (rs *RosettaService) ConstructionCombine(ctx context.Context, request *rtypes.ConstructionCombineRequest) (*rtypes.ConstructionCombineResponse, *rtypes.Error) {
 	txn, err := decodeTxn(request.UnsignedTransaction)
 	if err != nil {
 		return nil, errInvalidTxn(err)
 	}
+	// NOTE: with FullCoveredFields, the sighash of a signature does not
+	// depend on the other signatures, so these remain valid as we fill them in
+	sigIndices := make(map[crypto.Hash]int)
+	for i := range txn.TransactionSignatures {
+		sigIndices[txn.sigHash(i)] = i
+	}
+	seen := make(map[int]bool)
 	for _, sig := range request.Signatures {
-		// not the most efficient strategy, but the best we can do for now
 		var sigHash crypto.Hash
+		if len(sig.SigningPayload.Bytes) != len(sigHash) {
+			return nil, errInvalidSigningPayload(fmt.Errorf("payload has wrong length (%v bytes)", len(sig.SigningPayload.Bytes)))
+		}
 		copy(sigHash[:], sig.SigningPayload.Bytes)
-		for sigIndex := range txn.TransactionSignatures {
-			if txn.SigHash(sigIndex, stypes.ASICHardforkHeight+1) == sigHash {
-				txn.TransactionSignatures[sigIndex].Signature = sig.Bytes
-				break
-			}
+		i, ok := sigIndices[sigHash]
+		if !ok {
+			return nil, errInvalidSigningPayload(fmt.Errorf("unknown payload %v", sigHash))
+		} else if seen[i] {
+			return nil, errInvalidSigningPayload(fmt.Errorf("duplicate signature for payload %v", sigHash))
 		}
+		seen[i] = true
+
+		pk, ok := signingKey(txn.Transaction, i)
+		if !ok {
+			return nil, errInvalidTxn(fmt.Errorf("signature %v does not correspond to an input key", i))
+		} else if sig.SignatureType != rtypes.Ed25519 || pk.Algorithm != stypes.SignatureEd25519 {
+			return nil, errInvalidSignature(fmt.Errorf("signature for payload %v is not an ed25519 signature", sigHash))
+		}
+		var cpk crypto.PublicKey
+		var csig crypto.Signature
+		if len(pk.Key) != len(cpk) || len(sig.Bytes) != len(csig) {
+			return nil, errInvalidSignature(fmt.Errorf("signature for payload %v has wrong length", sigHash))
+		}
+		copy(cpk[:], pk.Key)
+		copy(csig[:], sig.Bytes)
+		if err := crypto.VerifyHash(sigHash, cpk, csig); err != nil {
+			return nil, errInvalidSignature(fmt.Errorf("signature for payload %v: %v", sigHash, err))
+		}
+		txn.TransactionSignatures[i].Signature = sig.Bytes
 	}
 	return &rtypes.ConstructionCombineResponse{
 		SignedTransaction: base64.StdEncoding.EncodeToString(encoding.Marshal(txn)),
 	}, nil
 }
 
-// ConstructionDerive implements the /construction/derive endpoint.
+// ConstructionDerive implements the /construction/derive endpoint. By default,
+// the standard address of the public key is returned. Other addresses may be
+// derived by specifying any of the following metadata fields:
+//
+//   public_keys         (hex-encoded ed25519 pubkeys, in order; must include
+//                       the request's public key)
+//   signatures_required (defaults to 1)
+//   timelock            (height at which the address becomes spendable;
+//                       defaults to 0)
+//
+// The resulting UnlockConditions are returned in the response metadata, and
+// must be supplied when spending from the address.
 func (rs *RosettaService) ConstructionDerive(ctx context.Context, request *rtypes.ConstructionDeriveRequest) (*rtypes.ConstructionDeriveResponse, *rtypes.Error) {
 	if request.PublicKey.CurveType != rtypes.Edwards25519 {
 		return nil, errUnsupportedCurve
 	}
+	uc := standardUnlockConditions(request.PublicKey.Bytes)
+	var hexKeys []string
+	if ok, err := decodeMetadata(request.Metadata, "public_keys", &hexKeys); err != nil {
+		return nil, errInvalidUnlockConditions(err)
+	} else if ok {
+		uc.PublicKeys = nil
+		var found bool
+		for _, s := range hexKeys {
+			key, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, errInvalidUnlockConditions(err)
+			}
+			found = found || bytes.Equal(key, request.PublicKey.Bytes)
+			uc.PublicKeys = append(uc.PublicKeys, stypes.SiaPublicKey{
+				Algorithm: stypes.SignatureEd25519,
+				Key:       key,
+			})
+		}
+		if !found {
+			return nil, errInvalidUnlockConditions(errors.New("public_keys does not include the request's public key"))
+		}
+	}
+	if _, err := decodeMetadata(request.Metadata, "signatures_required", &uc.SignaturesRequired); err != nil {
+		return nil, errInvalidUnlockConditions(err)
+	} else if uc.SignaturesRequired == 0 || uc.SignaturesRequired > uint64(len(uc.PublicKeys)) {
+		return nil, errInvalidUnlockConditions(fmt.Errorf("signatures_required must be between 1 and %v", len(uc.PublicKeys)))
+	}
+	if _, err := decodeMetadata(request.Metadata, "timelock", &uc.Timelock); err != nil {
+		return nil, errInvalidUnlockConditions(err)
+	}
 	return &rtypes.ConstructionDeriveResponse{
 		AccountIdentifier: &rtypes.AccountIdentifier{
-			Address: stypes.UnlockConditions{
-				PublicKeys: []stypes.SiaPublicKey{{
-					Algorithm: stypes.SignatureEd25519,
-					Key:       request.PublicKey.Bytes,
-				}},
-				SignaturesRequired: 1,
-				Timelock:           0,
-			}.UnlockHash().String(),
+			Address: uc.UnlockHash().String(),
+		},
+		Metadata: map[string]interface{}{
+			"unlock_conditions": uc,
 		},
 	}, nil
 }
@@ -89,12 +378,40 @@ func (rs *RosettaService) ConstructionHash(ctx context.Context, request *rtypes.
 	}, nil
 }
 
-// ConstructionMetadata implements the /construction/metadata endpoint.
+// ConstructionMetadata implements the /construction/metadata endpoint. The
+// suggested fee is derived from the transaction pool's fee estimate and the
+// estimated size of the transaction, as reported by /construction/preprocess.
 func (rs *RosettaService) ConstructionMetadata(ctx context.Context, request *rtypes.ConstructionMetadataRequest) (*rtypes.ConstructionMetadataResponse, *rtypes.Error) {
-	return &rtypes.ConstructionMetadataResponse{}, nil
+	if rs.offline() {
+		return nil, errOffline
+	}
+	size, ok := request.Options["estimated_size"].(float64)
+	if !ok || size < 0 {
+		return nil, errInvalidOptions(errors.New("missing or invalid estimated_size"))
+	}
+	multiplier := 1.0
+	if m, ok := request.Options["fee_multiplier"]; ok {
+		if multiplier, ok = m.(float64); !ok || multiplier < 0 {
+			return nil, errInvalidOptions(errors.New("invalid fee_multiplier"))
+		}
+	}
+	// like the Sia wallet, use the maximum recommended fee, so that the
+	// transaction is accepted even when the transaction pool is congested
+	_, feePerByte := rs.tp.FeeEstimation()
+	fee := feePerByte.MulFloat(size * multiplier)
+	return &rtypes.ConstructionMetadataResponse{
+		Metadata: map[string]interface{}{
+			"fee_per_byte": feePerByte.String(),
+			"height":       rs.cs.Height(),
+		},
+		SuggestedFee: []*rtypes.Amount{convertAmount(fee, true)},
+	}, nil
 }
 
-// ConstructionParse implements the /construction/parse endpoint.
+// ConstructionParse implements the /construction/parse endpoint. For a signed
+// transaction, the signers are the holders of the keys whose signatures have
+// been added; the payloads of any signatures that are still missing are
+// reported in the "missing_payloads" metadata field.
 func (rs *RosettaService) ConstructionParse(ctx context.Context, request *rtypes.ConstructionParseRequest) (*rtypes.ConstructionParseResponse, *rtypes.Error) {
 	txn, err := decodeTxn(request.Transaction)
 	if err != nil {
@@ -108,14 +425,35 @@ func (rs *RosettaService) ConstructionParse(ctx context.Context, request *rtypes
 	for i, sco := range txn.SiacoinOutputs {
 		ops = append(ops, transferOp(len(ops), sco, txn.SiacoinOutputID(uint64(i)), true))
 	}
+	for i, sfi := range txn.SiafundInputs {
+		ops = append(ops, siafundTransferOp(len(ops), txn.SiafundInputParents[i], sfi.ParentID, false))
+	}
+	for i, sfo := range txn.SiafundOutputs {
+		ops = append(ops, siafundTransferOp(len(ops), sfo, txn.SiafundOutputID(uint64(i)), true))
+	}
+	if fees := totalFees(txn.Transaction); !fees.IsZero() {
+		ops = append(ops, feeOp(len(ops), fees, true))
+	}
+	// report the holder of each key that has signed the transaction, along
+	// with the payloads that are still unsigned (if any)
 	var signers []*rtypes.AccountIdentifier
-	for _, sig := range txn.TransactionSignatures {
-		for _, in := range txn.SiacoinInputs {
-			if in.ParentID == stypes.SiacoinOutputID(sig.ParentID) {
-				signers = append(signers, &rtypes.AccountIdentifier{
-					Address: in.UnlockConditions.UnlockHash().String(),
-				})
-				break
+	var md map[string]interface{}
+	if request.Signed {
+		seen := make(map[string]bool)
+		for i, ts := range txn.TransactionSignatures {
+			pk, ok := signingKey(txn.Transaction, i)
+			if !ok || len(ts.Signature) == 0 {
+				continue
+			}
+			acct := signerAccount(pk)
+			if !seen[acct.Address] {
+				seen[acct.Address] = true
+				signers = append(signers, acct)
+			}
+		}
+		if missing := txn.missingPayloads(); len(missing) > 0 {
+			md = map[string]interface{}{
+				"missing_payloads": missing,
 			}
 		}
 	}
@@ -123,84 +461,137 @@ func (rs *RosettaService) ConstructionParse(ctx context.Context, request *rtypes
 	return &rtypes.ConstructionParseResponse{
 		Operations:               ops,
 		AccountIdentifierSigners: signers,
+		Metadata:                 md,
 	}, nil
 }
 
 // ConstructionPayloads implements the /construction/payloads endpoint. The
-// request must include an extra metadata field for each "input" operation:
+// request may contain Input, Output, and Fee operations, and the inputs must
+// exactly cover the outputs and fee. The request must include an extra
+// metadata field for each Input operation, either:
 //
 //   public_key        (hex-encoded ed25519 pubkey of the operation's address)
 //
+// or, for addresses with non-standard unlock conditions (e.g. multisig):
+//
+//   unlock_conditions (JSON-encoded UnlockConditions of the operation's address)
+//   public_key_indices (optional; indices of the keys that will sign, which
+//                      defaults to the first SignaturesRequired keys)
+//
+// A signing payload is returned for each signature required by each input. The
+// account of a payload is the standard address of the key that must sign it.
+//
+// If the request metadata includes the current height (as returned by
+// /construction/metadata), inputs whose unlock conditions are still timelocked
+// at that height are rejected, and the signing payloads are computed for the
+// rules in effect at the next height. Otherwise, every hardfork is assumed to
+// be active.
+//
+// Siafund inputs may also specify where their siacoin claim should be sent:
+//
+//   claim_address     (defaults to the operation's address)
+//
+// The transaction's miner fee is specified via a "Fee" operation, typically
+// using the fee suggested by /construction/metadata.
+//
+// If the transaction spends the outputs of other unconfirmed transactions, the
+// signed forms of those transactions (as returned by /construction/combine)
+// may be supplied via the request metadata:
+//
+//   parents           (list of signed transactions)
+//
+// They are then carried by the signed transaction, and submitted along with
+// it. (Unconfirmed parents that are already in the transaction pool are
+// attached automatically.)
 func (rs *RosettaService) ConstructionPayloads(ctx context.Context, request *rtypes.ConstructionPayloadsRequest) (*rtypes.ConstructionPayloadsResponse, *rtypes.Error) {
+	var height *stypes.BlockHeight
+	if _, err := decodeMetadata(request.Metadata, "height", &height); err != nil {
+		return nil, errInvalidOptions(err)
+	}
+	var parents []string
+	if _, err := decodeMetadata(request.Metadata, "parents", &parents); err != nil {
+		return nil, errInvalidOptions(err)
+	}
+	ops, rerr := validateConstructionOps(request.Operations, true)
+	if rerr != nil {
+		return nil, rerr
+	}
 	var txn constructionTxn
+	if height != nil {
+		// the transaction can be confirmed in the next block, at the earliest
+		txn.TargetHeight = *height + 1
+	}
+	for i, p := range parents {
+		ptxn, err := decodeTxn(p)
+		if err != nil {
+			return nil, errInvalidOptions(fmt.Errorf("invalid parent %v: %w", i, err))
+		}
+		txn.Parents = append(txn.Parents, ptxn.Parents...)
+		txn.Parents = append(txn.Parents, ptxn.Transaction)
+	}
+	txn.Parents = orderTransactionSet(txn.Parents)
 	var payloads []*rtypes.SigningPayload
-	for _, op := range request.Operations {
-		if strings.HasPrefix(op.Amount.Value, "-") {
-			var parentID stypes.SiacoinOutputID
-			err := (*crypto.Hash)(&parentID).LoadString(op.CoinChange.CoinIdentifier.Identifier)
-			if err != nil {
-				return nil, errInvalidUnlockConditions(err)
-			}
-			key, err := hex.DecodeString(op.Metadata["public_key"].(string))
-			if err != nil {
-				return nil, errInvalidUnlockConditions(err)
-			}
-			uc := stypes.UnlockConditions{
-				PublicKeys: []stypes.SiaPublicKey{{
-					Algorithm: stypes.SignatureEd25519,
-					Key:       key,
-				}},
-				SignaturesRequired: 1,
-				Timelock:           0,
-			}
-			// add input + sig
-			txn.SiacoinInputs = append(txn.SiacoinInputs, stypes.SiacoinInput{
-				ParentID:         parentID,
-				UnlockConditions: uc,
-			})
-			txn.TransactionSignatures = append(txn.TransactionSignatures, stypes.TransactionSignature{
-				ParentID:       crypto.Hash(parentID),
-				PublicKeyIndex: 0, // TODO: this assumes standard UnlockConditions
-				Timelock:       0,
-				CoveredFields:  stypes.FullCoveredFields,
-			})
-			payloads = append(payloads, &rtypes.SigningPayload{
-				AccountIdentifier: op.Account,
-				Bytes:             nil, // to be supplied later
-				SignatureType:     rtypes.Ed25519,
-			})
-			// add InputParent metadata
-			var parent stypes.SiacoinOutput
-			err = parent.UnlockHash.LoadString(op.Account.Address)
-			if err != nil {
-				return nil, errInvalidAddress(err)
+	for _, op := range ops {
+		switch op.Type {
+		case opTypeFee:
+			txn.MinerFees = append(txn.MinerFees, op.Value)
+		case opTypeInput:
+			uc := op.UnlockConditions
+			if height != nil && uc.Timelock > *height {
+				return nil, errInvalidUnlockConditions(fmt.Errorf("address is timelocked until height %v", uc.Timelock))
 			}
-			_, err = fmt.Sscan(op.Amount.Value[1:], &parent.Value)
-			if err != nil {
-				return nil, errInvalidAmount(err)
+			// add input + InputParent metadata
+			if op.Siafund {
+				txn.SiafundInputs = append(txn.SiafundInputs, stypes.SiafundInput{
+					ParentID:         stypes.SiafundOutputID(op.ParentID),
+					UnlockConditions: uc,
+					ClaimUnlockHash:  op.ClaimAddress,
+				})
+				txn.SiafundInputParents = append(txn.SiafundInputParents, stypes.SiafundOutput{
+					UnlockHash: op.Address,
+					Value:      op.Value,
+				})
+			} else {
+				txn.SiacoinInputs = append(txn.SiacoinInputs, stypes.SiacoinInput{
+					ParentID:         stypes.SiacoinOutputID(op.ParentID),
+					UnlockConditions: uc,
+				})
+				txn.InputParents = append(txn.InputParents, stypes.SiacoinOutput{
+					UnlockHash: op.Address,
+					Value:      op.Value,
+				})
 			}
-			txn.InputParents = append(txn.InputParents, parent)
-		} else {
-			// add output
-			var addr stypes.UnlockHash
-			err := addr.LoadString(op.Account.Address)
-			if err != nil {
-				return nil, errInvalidAddress(err)
+			// add sigs
+			for _, i := range op.KeyIndices {
+				txn.TransactionSignatures = append(txn.TransactionSignatures, stypes.TransactionSignature{
+					ParentID:       op.ParentID,
+					PublicKeyIndex: i,
+					Timelock:       0,
+					CoveredFields:  stypes.FullCoveredFields,
+				})
+				payloads = append(payloads, &rtypes.SigningPayload{
+					AccountIdentifier: signerAccount(uc.PublicKeys[i]),
+					Bytes:             nil, // to be supplied later
+					SignatureType:     rtypes.Ed25519,
+				})
 			}
-			var value stypes.Currency
-			_, err = fmt.Sscan(op.Amount.Value, &value)
-			if err != nil {
-				return nil, errInvalidAmount(err)
+		case opTypeOutput:
+			if op.Siafund {
+				txn.SiafundOutputs = append(txn.SiafundOutputs, stypes.SiafundOutput{
+					UnlockHash: op.Address,
+					Value:      op.Value,
+				})
+			} else {
+				txn.SiacoinOutputs = append(txn.SiacoinOutputs, stypes.SiacoinOutput{
+					UnlockHash: op.Address,
+					Value:      op.Value,
+				})
 			}
-			txn.SiacoinOutputs = append(txn.SiacoinOutputs, stypes.SiacoinOutput{
-				UnlockHash: addr,
-				Value:      value,
-			})
 		}
 	}
 	// compute signing payloads (this must be done after the transaction is fully constructed)
 	for i := range txn.TransactionSignatures {
-		sigHash := txn.SigHash(i, stypes.ASICHardforkHeight+1)
+		sigHash := txn.sigHash(i)
 		payloads[i].Bytes = sigHash[:]
 	}
 	return &rtypes.ConstructionPayloadsResponse{
@@ -209,20 +600,113 @@ func (rs *RosettaService) ConstructionPayloads(ctx context.Context, request *rty
 	}, nil
 }
 
-// ConstructionPreprocess implements the /construction/preprocess endpoint.
+// estimatedTxnSize returns the approximate encoded size of the signed
+// transaction described by ops. The transaction is assumed to pay a miner fee.
+func estimatedTxnSize(ops []constructionOp) int {
+	// use placeholder values large enough to hold any realistic amount
+	placeholder := stypes.SiacoinPrecision.Mul64(1e12)
+	txn := stypes.Transaction{
+		MinerFees: []stypes.Currency{placeholder},
+	}
+	for _, op := range ops {
+		switch {
+		case op.Type == opTypeInput:
+			if op.Siafund {
+				txn.SiafundInputs = append(txn.SiafundInputs, stypes.SiafundInput{UnlockConditions: op.UnlockConditions})
+			} else {
+				txn.SiacoinInputs = append(txn.SiacoinInputs, stypes.SiacoinInput{UnlockConditions: op.UnlockConditions})
+			}
+			for _, i := range op.KeyIndices {
+				txn.TransactionSignatures = append(txn.TransactionSignatures, stypes.TransactionSignature{
+					PublicKeyIndex: i,
+					CoveredFields:  stypes.FullCoveredFields,
+					Signature:      make([]byte, crypto.SignatureSize),
+				})
+			}
+		case op.Type == opTypeOutput && op.Siafund:
+			txn.SiafundOutputs = append(txn.SiafundOutputs, stypes.SiafundOutput{Value: placeholder})
+		case op.Type == opTypeOutput:
+			txn.SiacoinOutputs = append(txn.SiacoinOutputs, stypes.SiacoinOutput{Value: placeholder})
+		}
+	}
+	return txn.MarshalSiaSize()
+}
+
+// ConstructionPreprocess implements the /construction/preprocess endpoint. It
+// returns the estimated size of the transaction, which /construction/metadata
+// uses to suggest a fee.
 func (rs *RosettaService) ConstructionPreprocess(ctx context.Context, request *rtypes.ConstructionPreprocessRequest) (*rtypes.ConstructionPreprocessResponse, *rtypes.Error) {
-	// maybe return txnsig payloads?
-	return &rtypes.ConstructionPreprocessResponse{}, nil
+	// the keys of the inputs and the fee are not known until /construction/payloads
+	ops, rerr := validateConstructionOps(request.Operations, false)
+	if rerr != nil {
+		return nil, rerr
+	}
+	options := map[string]interface{}{
+		// NOTE: options are sent as JSON, so numbers are always float64
+		"estimated_size": float64(estimatedTxnSize(ops)),
+	}
+	if request.SuggestedFeeMultiplier != nil {
+		options["fee_multiplier"] = *request.SuggestedFeeMultiplier
+	}
+	return &rtypes.ConstructionPreprocessResponse{
+		Options: options,
+	}, nil
 }
 
-// ConstructionSubmit implements the /construction/submit endpoint.
+// ConstructionSubmit implements the /construction/submit endpoint. The
+// transaction is submitted atomically along with its unconfirmed parents,
+// i.e. those carried by the signed transaction and those already in the
+// transaction pool. The transaction must carry every required signature; see
+// ConstructionCombine. Accepted transaction sets are recorded in the database,
+// and rebroadcast periodically until they are confirmed or dropped; see
+// ConstructionStatus.
 func (rs *RosettaService) ConstructionSubmit(ctx context.Context, request *rtypes.ConstructionSubmitRequest) (*rtypes.TransactionIdentifierResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
 	txn, err := decodeTxn(request.SignedTransaction)
 	if err != nil {
 		return nil, errInvalidTxn(err)
-	} else if err := rs.tp.AcceptTransactionSet([]stypes.Transaction{txn.Transaction}); err != nil {
+	} else if missing := txn.missingPayloads(); len(missing) > 0 {
+		rerr := errMissingSignatures(fmt.Errorf("%v of %v signatures are missing", len(missing), len(txn.TransactionSignatures)))
+		rerr.Details["missing_payloads"] = missing
+		return nil, rerr
+	}
+	// omit any carried parents that have since been confirmed, and attach any
+	// unconfirmed parents from the transaction pool
+	var set []stypes.Transaction
+	err = rs.dbView(func(h *txnHelper) {
+		for _, p := range txn.Parents {
+			if !h.get(keyTxn(crypto.Hash(p.ID())), new(txnLocation)) {
+				set = append(set, p)
+			}
+		}
+	})
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	set = append(set, txn.Transaction)
+	pool := rs.tp.Transactions()
+	uo := newUnconfirmedOutputs(pool)
+	for _, t := range set {
+		for _, i := range uo.parents(t, pool) {
+			set = append(set, pool[i])
+		}
+	}
+	set = orderTransactionSet(set)
+	if err := rs.tp.AcceptTransactionSet(set); err != nil {
 		return nil, errTxnNotAccepted(err)
 	}
+	// track the transaction so that it can be rebroadcast
+	err = rs.dbUpdate(func(h *txnHelper) {
+		h.putSubmission(crypto.Hash(txn.ID()), dbSubmission{
+			Set:       set,
+			Timestamp: stypes.CurrentTimestamp(),
+		})
+	})
+	if err != nil {
+		return nil, errDatabase(fmt.Errorf("transaction was accepted, but could not be tracked: %w", err))
+	}
 	return &rtypes.TransactionIdentifierResponse{
 		TransactionIdentifier: &rtypes.TransactionIdentifier{
 			Hash: txn.ID().String(),
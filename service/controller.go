@@ -0,0 +1,45 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coinbase/rosetta-sdk-go/asserter"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// endpointRequest is the request type of a non-standard endpoint.
+type endpointRequest interface {
+	network() *rtypes.NetworkIdentifier
+	// validate asserts that the request is well-formed, i.e. that it can
+	// safely be passed to the corresponding RosettaService method.
+	validate() error
+}
+
+// serveEndpoint implements the handler of a non-standard endpoint, mirroring
+// the handlers generated by the Rosetta SDK. It decodes the body of r into
+// request, asserts that the request is valid and targets a supported network,
+// and then encodes the response (or error) returned by fn.
+func serveEndpoint(w http.ResponseWriter, r *http.Request, a *asserter.Asserter, request endpointRequest, fn func() (interface{}, *rtypes.Error)) {
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err == nil {
+		err = a.ValidSupportedNetwork(request.network())
+	}
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		server.EncodeJSONResponse(&rtypes.Error{
+			Message: err.Error(),
+		}, http.StatusInternalServerError, w)
+		return
+	}
+
+	resp, rerr := fn()
+	if rerr != nil {
+		server.EncodeJSONResponse(rerr, http.StatusInternalServerError, w)
+		return
+	}
+	server.EncodeJSONResponse(resp, http.StatusOK, w)
+}
@@ -1,11 +1,11 @@
 package service
 
 import (
-	"bytes"
 	"encoding/binary"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"github.com/dgraph-io/badger"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/encoding"
@@ -19,10 +19,20 @@ var (
 	keyCurrentBlockID    = []byte("currentblockid")
 	keyConsensusChangeID = []byte("consensuschangeid")
 	keyVoidBalance       = []byte("voidbalance")
+	keyEventCount        = []byte("eventcount")
+	keyReindexing        = []byte("reindexing") // set while Reindex is incomplete
+	keyFoundationPrimary = []byte("foundationprimary")
 )
 
-func keyAddress(addr stypes.UnlockHash) []byte {
-	return append([]byte("addrs"), addr[:]...)
+// keyAddressUTXO returns a key associating a siacoin output with the address
+// that controls it. The keys of an address share a common prefix, allowing its
+// outputs to be enumerated via prefix iteration.
+func keyAddressUTXO(addr stypes.UnlockHash, id stypes.SiacoinOutputID) []byte {
+	return append(append([]byte(prefixAddressUTXOs), addr[:]...), id[:]...)
+}
+
+func keyAddressTotals(addr stypes.UnlockHash) []byte {
+	return append([]byte("addrtotals"), addr[:]...)
 }
 
 func keyBlockID(bid stypes.BlockID) []byte {
@@ -33,7 +43,85 @@ func keyUTXO(scoid stypes.SiacoinOutputID) []byte {
 	return append([]byte("utxos"), scoid[:]...)
 }
 
-func convertAmount(c stypes.Currency, positive bool) *rtypes.Amount {
+func keySiafundAddressUTXO(addr stypes.UnlockHash, id stypes.SiafundOutputID) []byte {
+	return append(append([]byte(prefixSiafundAddressUTXOs), addr[:]...), id[:]...)
+}
+
+func keySiafundUTXO(sfoid stypes.SiafundOutputID) []byte {
+	return append([]byte("sfutxos"), sfoid[:]...)
+}
+
+func keyBalance(addr stypes.UnlockHash, height stypes.BlockHeight) []byte {
+	key := make([]byte, len("balances")+32+8)
+	n := copy(key, "balances")
+	n += copy(key[n:], addr[:])
+	binary.BigEndian.PutUint64(key[n:], uint64(height))
+	return key
+}
+
+// keyPrunable returns a key associating a height with the block at that height
+// whose spent outputs have not yet been pruned. The height is encoded
+// big-endian so that keys sort by height.
+func keyPrunable(height stypes.BlockHeight) []byte {
+	key := make([]byte, len(prefixPrunable)+8)
+	n := copy(key, prefixPrunable)
+	binary.BigEndian.PutUint64(key[n:], uint64(height))
+	return key
+}
+
+func keyEvent(seq uint64) []byte {
+	key := make([]byte, len("events")+8)
+	n := copy(key, "events")
+	binary.BigEndian.PutUint64(key[n:], seq)
+	return key
+}
+
+func keyFoundationSubsidy(id stypes.SiacoinOutputID) []byte {
+	return append([]byte(prefixFoundationSubsidies), id[:]...)
+}
+
+func keyTxn(txid crypto.Hash) []byte {
+	return append([]byte("txns"), txid[:]...)
+}
+
+const prefixSubmissions = "submitted"
+
+func keySubmission(txid crypto.Hash) []byte {
+	return append([]byte(prefixSubmissions), txid[:]...)
+}
+
+// keyTxnRef returns a key associating a transaction with an address or coin.
+// The height is encoded big-endian so that refs sort chronologically.
+func keyTxnRef(prefix string, id [32]byte, height stypes.BlockHeight, txid crypto.Hash) []byte {
+	key := make([]byte, len(prefix)+32+8+32)
+	n := copy(key, prefix)
+	n += copy(key[n:], id[:])
+	binary.BigEndian.PutUint64(key[n:], uint64(height))
+	copy(key[n+8:], txid[:])
+	return key
+}
+
+const (
+	prefixAddressTxns         = "addrtxns"
+	prefixCoinTxns            = "cointxns"
+	prefixAddressUTXOs        = "addrutxos"
+	prefixSiafundAddressUTXOs = "sfaddrutxos"
+	prefixPrunable            = "prunable"
+	prefixFoundationSubsidies = "fsubsidies"
+)
+
+var (
+	currencySiacoin = &rtypes.Currency{
+		Symbol:   "SC",
+		Decimals: 24,
+	}
+	currencySiafund = &rtypes.Currency{
+		Symbol:   "SF",
+		Decimals: 0,
+	}
+)
+
+func newAmount(c stypes.Currency, positive bool, currency *rtypes.Currency) *rtypes.Amount {
 	s := c.String()
 	if !positive {
 		s = "-" + s
@@ -41,13 +129,21 @@ func convertAmount(c stypes.Currency, positive bool) *rtypes.Amount {
 	return &rtypes.Amount{
 		Value: s,
 		Currency: &rtypes.Currency{
-			Symbol:   "SC",
-			Decimals: 24,
+			Symbol:   currency.Symbol,
+			Decimals: currency.Decimals,
 		},
 	}
 }
 
-func transferOp(index int, sco stypes.SiacoinOutput, id stypes.SiacoinOutputID, credit bool) *rtypes.Operation {
+func convertAmount(c stypes.Currency, positive bool) *rtypes.Amount {
+	return newAmount(c, positive, currencySiacoin)
+}
+
+func convertSiafundAmount(c stypes.Currency, positive bool) *rtypes.Amount {
+	return newAmount(c, positive, currencySiafund)
+}
+
+func newTransferOp(index int, addr stypes.UnlockHash, id string, amount *rtypes.Amount, credit bool) *rtypes.Operation {
 	action := rtypes.CoinSpent
 	typ := opTypeInput
 	if credit {
@@ -61,21 +157,199 @@ func transferOp(index int, sco stypes.SiacoinOutput, id stypes.SiacoinOutputID,
 		Type:   typ,
 		Status: rtypes.String("Applied"),
 		Account: &rtypes.AccountIdentifier{
-			Address: sco.UnlockHash.String(),
+			Address: addr.String(),
 		},
 		CoinChange: &rtypes.CoinChange{
 			CoinIdentifier: &rtypes.CoinIdentifier{
-				Identifier: id.String(),
+				Identifier: id,
 			},
 			CoinAction: action,
 		},
-		Amount: convertAmount(sco.Value, credit),
+		Amount: amount,
+	}
+}
+
+func transferOp(index int, sco stypes.SiacoinOutput, id stypes.SiacoinOutputID, credit bool) *rtypes.Operation {
+	return newTransferOp(index, sco.UnlockHash, id.String(), convertAmount(sco.Value, credit), credit)
+}
+
+// contractOp returns an operation affecting the synthetic account of a file
+// contract. amount may be nil.
+func contractOp(index int, typ string, id stypes.FileContractID, amount *rtypes.Amount) *rtypes.Operation {
+	return &rtypes.Operation{
+		OperationIdentifier: &rtypes.OperationIdentifier{
+			Index: int64(index),
+		},
+		Type:   typ,
+		Status: rtypes.String("Applied"),
+		Account: &rtypes.AccountIdentifier{
+			Address: id.String(),
+		},
+		Amount: amount,
+	}
+}
+
+func siafundTransferOp(index int, sfo stypes.SiafundOutput, id stypes.SiafundOutputID, credit bool) *rtypes.Operation {
+	return newTransferOp(index, sfo.UnlockHash, id.String(), convertSiafundAmount(sfo.Value, credit), credit)
+}
+
+// contractValue returns the value held by a file contract, i.e. its payout
+// minus the siafund tax.
+func contractValue(fc stypes.FileContract) (value stypes.Currency) {
+	for _, sco := range fc.ValidProofOutputs {
+		value = value.Add(sco.Value)
+	}
+	return
+}
+
+// contractAccount returns the synthetic account that holds the value of a
+// file contract until it is resolved.
+func contractAccount(id stypes.FileContractID) stypes.UnlockHash {
+	return stypes.UnlockHash(id)
+}
+
+// minerFeesAddress is the address of the synthetic account that collects the
+// miner fees of each transaction. The account is debited by the total fees of
+// the block in the block's payout transaction, so its balance is always zero
+// between blocks.
+const minerFeesAddress = "miner_fees"
+
+// minerFeesAccount is used as the key of the miner fees account in the
+// address index, which records each fee credited to the account along with the
+// block's matching debit. Since these net to zero within each block, no
+// balance entries are recorded for it, and its balance is always reported as
+// zero.
+var minerFeesAccount = stypes.UnlockHash(crypto.HashBytes([]byte(minerFeesAddress)))
+
+func totalFees(txn stypes.Transaction) (fees stypes.Currency) {
+	for _, fee := range txn.MinerFees {
+		fees = fees.Add(fee)
+	}
+	return
+}
+
+// feeOp returns an operation affecting the miner fees account.
+func feeOp(index int, fees stypes.Currency, credit bool) *rtypes.Operation {
+	return &rtypes.Operation{
+		OperationIdentifier: &rtypes.OperationIdentifier{
+			Index: int64(index),
+		},
+		Type:   opTypeFee,
+		Status: rtypes.String("Applied"),
+		Account: &rtypes.AccountIdentifier{
+			Address: minerFeesAddress,
+		},
+		Amount: convertAmount(fees, credit),
+	}
+}
+
+// siafundPoolAddress is the address of the synthetic account that collects the
+// siafund tax paid by newly formed file contracts. The account is debited by
+// the siafund claims paid out in each block's payout transaction, so its
+// balance is the portion of the siafund pool that has not yet been claimed.
+const siafundPoolAddress = "siafund_pool"
+
+// siafundPoolAccount is used as the key of the siafund pool account in the
+// balance index.
+var siafundPoolAccount = stypes.UnlockHash(crypto.HashBytes([]byte(siafundPoolAddress)))
+
+// contractTax returns the siafund tax paid by a file contract.
+func contractTax(fc stypes.FileContract) stypes.Currency {
+	return fc.Payout.Sub(contractValue(fc))
+}
+
+// siafundPoolOp returns an operation affecting the siafund pool account.
+func siafundPoolOp(index int, typ string, value stypes.Currency, credit bool) *rtypes.Operation {
+	return &rtypes.Operation{
+		OperationIdentifier: &rtypes.OperationIdentifier{
+			Index: int64(index),
+		},
+		Type:   typ,
+		Status: rtypes.String("Applied"),
+		Account: &rtypes.AccountIdentifier{
+			Address: siafundPoolAddress,
+		},
+		Amount: convertAmount(value, credit),
+	}
+}
+
+// claimOutputIDs returns the IDs of the siafund claim outputs created by b.
+func claimOutputIDs(b stypes.Block) map[stypes.SiacoinOutputID]struct{} {
+	claims := make(map[stypes.SiacoinOutputID]struct{})
+	for _, txn := range b.Transactions {
+		for _, sfi := range txn.SiafundInputs {
+			claims[sfi.ParentID.SiaClaimOutputID()] = struct{}{}
+		}
 	}
+	return claims
+}
+
+// siafundPoolFlows returns the siafund tax paid into the siafund pool by b,
+// and the siafund claims paid out of it.
+func siafundPoolFlows(b stypes.Block, info blockInfo) (tax, claimed stypes.Currency) {
+	for _, txn := range b.Transactions {
+		for _, fc := range txn.FileContracts {
+			tax = tax.Add(contractTax(fc))
+		}
+	}
+	claims := claimOutputIDs(b)
+	for _, do := range info.DelayedOutputs {
+		if _, ok := claims[do.ID]; ok {
+			claimed = claimed.Add(do.SiacoinOutput.Value)
+		}
+	}
+	return
+}
+
+// resolvedContract is a file contract that was resolved by a block, either
+// via a storage proof or by expiring.
+type resolvedContract struct {
+	ID         stypes.FileContractID
+	Value      stypes.Currency
+	Valid      bool
+	NumOutputs uint64
+}
+
+// outputIDs returns the IDs of the outputs created by resolving the contract.
+func (rc resolvedContract) outputIDs() []stypes.SiacoinOutputID {
+	status := stypes.ProofMissed
+	if rc.Valid {
+		status = stypes.ProofValid
+	}
+	ids := make([]stypes.SiacoinOutputID, rc.NumOutputs)
+	for i := range ids {
+		ids[i] = rc.ID.StorageProofOutputID(status, uint64(i))
+	}
+	return ids
+}
+
+// spentOutput is an output spent by a block.
+type spentOutput struct {
+	ID    [32]byte
+	Value stypes.Currency
 }
 
 type blockInfo struct {
-	Height         int64
-	DelayedOutputs []modules.DelayedSiacoinOutputDiff // from miner payouts and file contracts
+	Height            int64
+	DelayedOutputs    []modules.DelayedSiacoinOutputDiff // from miner payouts and file contracts
+	ResolvedContracts []resolvedContract
+	// the outputs spent by the block's transactions, which are needed to
+	// convert its inputs once the outputs have been pruned
+	SpentSiacoinOutputs []spentOutput
+	SpentSiafundOutputs []spentOutput
+	FoundationUpdate    *foundationUpdate // nil if the block has no update
+}
+
+// inputValues returns the values of the outputs spent by the block.
+func (info blockInfo) inputValues() inputValues {
+	values := make(inputValues, len(info.SpentSiacoinOutputs)+len(info.SpentSiafundOutputs))
+	for _, so := range info.SpentSiacoinOutputs {
+		values[so.ID] = so.Value
+	}
+	for _, so := range info.SpentSiafundOutputs {
+		values[so.ID] = so.Value
+	}
+	return values
 }
 
 func parseBlock(b stypes.Block, height stypes.BlockHeight, diffs modules.ConsensusChangeDiffs) blockInfo {
@@ -85,12 +359,151 @@ func parseBlock(b stypes.Block, height stypes.BlockHeight, diffs modules.Consens
 			outputs = append(outputs, dscod)
 		}
 	}
+	// a contract is resolved if it is removed and not re-added (as it would
+	// be by a revision)
+	proofs := make(map[stypes.FileContractID]bool)
+	for _, txn := range b.Transactions {
+		for _, sp := range txn.StorageProofs {
+			proofs[sp.ParentID] = true
+		}
+	}
+	readded := make(map[stypes.FileContractID]bool)
+	for _, fcd := range diffs.FileContractDiffs {
+		readded[fcd.ID] = fcd.Direction == modules.DiffApply
+	}
+	var spent, sfSpent []spentOutput
+	for _, scod := range diffs.SiacoinOutputDiffs {
+		if scod.Direction == modules.DiffRevert {
+			spent = append(spent, spentOutput{scod.ID, scod.SiacoinOutput.Value})
+		}
+	}
+	for _, sfod := range diffs.SiafundOutputDiffs {
+		if sfod.Direction == modules.DiffRevert {
+			sfSpent = append(sfSpent, spentOutput{sfod.ID, sfod.SiafundOutput.Value})
+		}
+	}
+	var resolved []resolvedContract
+	for _, fcd := range diffs.FileContractDiffs {
+		if fcd.Direction == modules.DiffRevert && !readded[fcd.ID] {
+			rc := resolvedContract{
+				ID:         fcd.ID,
+				Value:      contractValue(fcd.FileContract),
+				Valid:      proofs[fcd.ID],
+				NumOutputs: uint64(len(fcd.FileContract.MissedProofOutputs)),
+			}
+			if rc.Valid {
+				rc.NumOutputs = uint64(len(fcd.FileContract.ValidProofOutputs))
+			}
+			resolved = append(resolved, rc)
+		}
+	}
 	return blockInfo{
-		Height:         int64(height),
-		DelayedOutputs: outputs,
+		Height:              int64(height),
+		DelayedOutputs:      outputs,
+		ResolvedContracts:   resolved,
+		SpentSiacoinOutputs: spent,
+		SpentSiafundOutputs: sfSpent,
 	}
 }
 
+// payoutTxnIndex is the txnLocation.Index of the synthetic transaction
+// containing a block's miner payouts and file contract resolutions. The ID of
+// this transaction is the ID of the block.
+const payoutTxnIndex = ^uint64(0)
+
+// txnLocation is the position of a transaction within the blockchain.
+type txnLocation struct {
+	BlockID stypes.BlockID
+	Height  stypes.BlockHeight
+	Index   uint64
+}
+
+// txnRef is a reference to a transaction from an address or coin.
+type txnRef struct {
+	Height stypes.BlockHeight
+	ID     crypto.Hash
+}
+
+// blockTxn summarizes the changes to addresses and coins made by a
+// transaction.
+type blockTxn struct {
+	ID     crypto.Hash
+	Index  uint64
+	Deltas balanceDeltas
+	Coins  [][32]byte
+}
+
+func blockTxns(b stypes.Block, info blockInfo) []blockTxn {
+	values := info.inputValues()
+	txns := make([]blockTxn, 0, len(b.Transactions)+1)
+	var blockFees stypes.Currency
+	for i, txn := range b.Transactions {
+		bt := blockTxn{
+			ID:     crypto.Hash(txn.ID()),
+			Index:  uint64(i),
+			Deltas: make(balanceDeltas),
+		}
+		for _, sci := range txn.SiacoinInputs {
+			bt.Deltas.addSiacoins(sci.UnlockConditions.UnlockHash(), values[sci.ParentID], false)
+			bt.Coins = append(bt.Coins, sci.ParentID)
+		}
+		for i, sco := range txn.SiacoinOutputs {
+			bt.Deltas.addSiacoins(sco.UnlockHash, sco.Value, true)
+			bt.Coins = append(bt.Coins, txn.SiacoinOutputID(uint64(i)))
+		}
+		for _, sfi := range txn.SiafundInputs {
+			bt.Deltas.addSiafunds(sfi.UnlockConditions.UnlockHash(), values[sfi.ParentID], false)
+			bt.Coins = append(bt.Coins, sfi.ParentID)
+		}
+		for i, sfo := range txn.SiafundOutputs {
+			bt.Deltas.addSiafunds(sfo.UnlockHash, sfo.Value, true)
+			bt.Coins = append(bt.Coins, txn.SiafundOutputID(uint64(i)))
+		}
+		for i, fc := range txn.FileContracts {
+			bt.Deltas.addSiacoins(contractAccount(txn.FileContractID(uint64(i))), contractValue(fc), true)
+			bt.Deltas.addSiacoins(siafundPoolAccount, contractTax(fc), true)
+		}
+		for _, fcr := range txn.FileContractRevisions {
+			bt.Deltas.get(contractAccount(fcr.ParentID))
+		}
+		for _, sp := range txn.StorageProofs {
+			bt.Deltas.get(contractAccount(sp.ParentID))
+		}
+		if fees := totalFees(txn); !fees.IsZero() {
+			bt.Deltas.addSiacoins(minerFeesAccount, fees, true)
+			blockFees = blockFees.Add(fees)
+		}
+		if fu := info.FoundationUpdate; fu != nil && fu.TxnIndex == uint64(i) {
+			bt.Deltas.get(fu.NewPrimary)
+			for _, t := range fu.Transfers {
+				bt.Deltas.addSiacoins(t.From, t.Value, false)
+				bt.Deltas.addSiacoins(fu.NewPrimary, t.Value, true)
+				bt.Coins = append(bt.Coins, t.ID)
+			}
+		}
+		txns = append(txns, bt)
+	}
+	payouts := blockTxn{
+		ID:     crypto.Hash(b.ID()),
+		Index:  payoutTxnIndex,
+		Deltas: make(balanceDeltas),
+	}
+	if !blockFees.IsZero() {
+		payouts.Deltas.addSiacoins(minerFeesAccount, blockFees, false)
+	}
+	for _, do := range info.DelayedOutputs {
+		payouts.Deltas.addSiacoins(do.SiacoinOutput.UnlockHash, do.SiacoinOutput.Value, true)
+		payouts.Coins = append(payouts.Coins, do.ID)
+	}
+	for _, rc := range info.ResolvedContracts {
+		payouts.Deltas.addSiacoins(contractAccount(rc.ID), rc.Value, false)
+	}
+	if _, claimed := siafundPoolFlows(b, info); !claimed.IsZero() {
+		payouts.Deltas.addSiacoins(siafundPoolAccount, claimed, false)
+	}
+	return append(txns, payouts)
+}
+
 type txnHelper struct {
 	txn *badger.Txn
 	err error
@@ -116,6 +529,19 @@ func (h *txnHelper) getBytes(key []byte) (v []byte) {
 	return
 }
 
+func (h *txnHelper) has(key []byte) bool {
+	if h.err == nil {
+		_, err := h.txn.Get(key)
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				h.err = err
+			}
+			return false
+		}
+	}
+	return h.err == nil
+}
+
 func (h *txnHelper) get(key []byte, v interface{}) bool {
 	if h.err == nil {
 		item, err := h.txn.Get(key)
@@ -206,6 +632,33 @@ func (h *txnHelper) deleteBlockInfo(id stypes.BlockID) {
 	h.delete(keyBlockID(id))
 }
 
+// dbEvent records the addition or removal of a block from the best chain.
+type dbEvent struct {
+	BlockID stypes.BlockID
+	Height  stypes.BlockHeight
+	Removed bool
+}
+
+func (h *txnHelper) getEventCount() (n uint64) {
+	h.get(keyEventCount, &n)
+	return
+}
+
+// appendEvent adds an event to the end of the event log.
+func (h *txnHelper) appendEvent(ev dbEvent) {
+	n := h.getEventCount()
+	h.put(keyEvent(n), ev)
+	h.put(keyEventCount, n+1)
+}
+
+func (h *txnHelper) getEvents(start, n uint64) (events []dbEvent) {
+	events = make([]dbEvent, n)
+	for i := range events {
+		h.mustGet(keyEvent(start+uint64(i)), &events[i])
+	}
+	return
+}
+
 type dbUTXO struct {
 	Value    stypes.Currency
 	Timelock stypes.BlockHeight
@@ -220,47 +673,502 @@ func (h *txnHelper) putUTXO(id stypes.SiacoinOutputID, value stypes.Currency, ti
 	h.put(keyUTXO(id), dbUTXO{value, timelock})
 }
 
-// NOTE: there is no deleteUTXO; all UTXOs are kept indefinitely
+func (h *txnHelper) deleteUTXO(id stypes.SiacoinOutputID) {
+	h.delete(keyUTXO(id))
+}
 
-func (h *txnHelper) giveUTXO(addr stypes.UnlockHash, id stypes.SiacoinOutputID, value stypes.Currency) {
+// giveUTXO associates a siacoin output with the address that controls it.
+// Delayed outputs (i.e. miner payouts and file contract resolutions that have
+// not yet matured) are locked.
+func (h *txnHelper) giveUTXO(addr stypes.UnlockHash, id stypes.SiacoinOutputID, value stypes.Currency, locked bool) {
 	if addr == (stypes.UnlockHash{}) {
 		h.putVoidBalance(h.getVoidBalance().Add(value))
 		return
 	}
-	// because this is one of the "hottest" functions, we encode+decode manually
-	utxoBytes := h.getBytes(keyAddress(addr))
-	if bytes.Contains(utxoBytes, id[:]) {
+	key := keyAddressUTXO(addr, id)
+	if h.has(key) {
 		panic("attempted to give UTXO already owned by address")
 	}
-	// append+increment
-	if len(utxoBytes) == 0 {
-		utxoBytes = make([]byte, 8, 8+32) // initial length of 0
+	h.putBytes(key, nil)
+	t := h.getAddressTotals(addr)
+	t.SiacoinOutputs++
+	t.Siacoins = t.Siacoins.Add(value)
+	if locked {
+		t.LockedSiacoins = t.LockedSiacoins.Add(value)
 	}
-	utxoBytes = append(utxoBytes, id[:]...)
-	binary.LittleEndian.PutUint64(utxoBytes[:8], binary.LittleEndian.Uint64(utxoBytes[:8])+1)
-	h.putBytes(keyAddress(addr), utxoBytes)
+	h.putAddressTotals(addr, t)
 }
 
-func (h *txnHelper) takeUTXO(addr stypes.UnlockHash, id stypes.SiacoinOutputID, value stypes.Currency) {
+func (h *txnHelper) takeUTXO(addr stypes.UnlockHash, id stypes.SiacoinOutputID, value stypes.Currency, locked bool) {
 	if addr == (stypes.UnlockHash{}) {
 		h.putVoidBalance(h.getVoidBalance().Sub(value))
 		return
 	}
-	// because this is one of the "hottest" functions, we encode+decode manually
-	utxoBytes := h.getBytes(keyAddress(addr))
-	i := bytes.Index(utxoBytes, id[:])
-	if i < 8 {
+	key := keyAddressUTXO(addr, id)
+	if !h.has(key) && h.err == nil {
 		panic("attempted to take UTXO not owned by address")
-	} else if (i-8)%32 != 0 {
-		panic("misaligned id") // should never happen
-	}
-	// delete+decrement
-	copy(utxoBytes[i:], utxoBytes[len(utxoBytes)-32:])
-	utxoBytes = utxoBytes[:len(utxoBytes)-32]
-	binary.LittleEndian.PutUint64(utxoBytes[:8], binary.LittleEndian.Uint64(utxoBytes[:8])-1)
-	if len(utxoBytes) == 8 {
-		h.delete(keyAddress(addr))
+	}
+	h.delete(key)
+	t := h.getAddressTotals(addr)
+	t.SiacoinOutputs--
+	t.Siacoins = t.Siacoins.Sub(value)
+	if locked {
+		t.LockedSiacoins = t.LockedSiacoins.Sub(value)
+	}
+	h.putAddressTotals(addr, t)
+}
+
+func (h *txnHelper) getSiafundUTXO(id stypes.SiafundOutputID) (value stypes.Currency) {
+	h.mustGet(keySiafundUTXO(id), &value)
+	return
+}
+
+func (h *txnHelper) putSiafundUTXO(id stypes.SiafundOutputID, value stypes.Currency) {
+	h.put(keySiafundUTXO(id), value)
+}
+
+func (h *txnHelper) deleteSiafundUTXO(id stypes.SiafundOutputID) {
+	h.delete(keySiafundUTXO(id))
+}
+
+// NOTE: siafund outputs are rare enough that the void address does not
+// require special handling.
+
+func (h *txnHelper) giveSiafundUTXO(addr stypes.UnlockHash, id stypes.SiafundOutputID, value stypes.Currency) {
+	key := keySiafundAddressUTXO(addr, id)
+	if h.has(key) {
+		panic("attempted to give UTXO already owned by address")
+	}
+	h.putBytes(key, nil)
+	t := h.getAddressTotals(addr)
+	t.SiafundOutputs++
+	t.Siafunds = t.Siafunds.Add(value)
+	h.putAddressTotals(addr, t)
+}
+
+func (h *txnHelper) takeSiafundUTXO(addr stypes.UnlockHash, id stypes.SiafundOutputID, value stypes.Currency) {
+	key := keySiafundAddressUTXO(addr, id)
+	if !h.has(key) && h.err == nil {
+		panic("attempted to take UTXO not owned by address")
+	}
+	h.delete(key)
+	t := h.getAddressTotals(addr)
+	t.SiafundOutputs--
+	t.Siafunds = t.Siafunds.Sub(value)
+	h.putAddressTotals(addr, t)
+}
+
+func (h *txnHelper) getFoundationPrimary() (primary stypes.UnlockHash) {
+	h.mustGet(keyFoundationPrimary, &primary)
+	return
+}
+
+func (h *txnHelper) putFoundationPrimary(primary stypes.UnlockHash) {
+	h.put(keyFoundationPrimary, primary)
+}
+
+func (h *txnHelper) putFoundationSubsidy(id stypes.SiacoinOutputID, fs dbFoundationSubsidy) {
+	h.put(keyFoundationSubsidy(id), fs)
+}
+
+func (h *txnHelper) deleteFoundationSubsidy(id stypes.SiacoinOutputID) {
+	h.delete(keyFoundationSubsidy(id))
+}
+
+// getFoundationSubsidies returns every Foundation subsidy output created by
+// the current chain, ordered by ID.
+func (h *txnHelper) getFoundationSubsidies() (ids []stypes.SiacoinOutputID, subsidies []dbFoundationSubsidy) {
+	if h.err != nil {
+		return
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixFoundationSubsidies)
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var id stypes.SiacoinOutputID
+		copy(id[:], it.Item().Key()[len(prefixFoundationSubsidies):])
+		var fs dbFoundationSubsidy
+		h.err = it.Item().Value(func(val []byte) error {
+			return encoding.Unmarshal(val, &fs)
+		})
+		if h.err != nil {
+			return nil, nil
+		}
+		ids = append(ids, id)
+		subsidies = append(subsidies, fs)
+	}
+	return
+}
+
+// putPrunable marks the outputs spent by the block at height as prunable.
+func (h *txnHelper) putPrunable(height stypes.BlockHeight, bid stypes.BlockID) {
+	h.put(keyPrunable(height), bid)
+}
+
+// deletePrunable unmarks the outputs spent by the block at height. It must be
+// called when the block is reverted, since those outputs are then unspent.
+func (h *txnHelper) deletePrunable(height stypes.BlockHeight) {
+	h.delete(keyPrunable(height))
+}
+
+// pruneSpentOutputs deletes the outputs spent by each prunable block at or
+// below height. The inputs of those blocks can still be converted using the
+// spent outputs recorded in their blockInfo.
+func (h *txnHelper) pruneSpentOutputs(height stypes.BlockHeight) {
+	if h.err != nil {
+		return
+	}
+	var keys [][]byte
+	var bids []stypes.BlockID
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixPrunable)
+	it := h.txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if stypes.BlockHeight(binary.BigEndian.Uint64(key[len(prefixPrunable):])) > height {
+			break
+		}
+		var bid stypes.BlockID
+		h.err = it.Item().Value(func(val []byte) error {
+			return encoding.Unmarshal(val, &bid)
+		})
+		if h.err != nil {
+			break
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+		bids = append(bids, bid)
+	}
+	it.Close()
+
+	for i, bid := range bids {
+		info := h.getBlockInfo(bid)
+		for _, so := range info.SpentSiacoinOutputs {
+			h.deleteUTXO(so.ID)
+		}
+		for _, so := range info.SpentSiafundOutputs {
+			h.deleteSiafundUTXO(so.ID)
+		}
+		h.delete(keys[i])
+	}
+}
+
+// isUnspent reports whether the siacoin output id, controlled by addr, is
+// currently unspent.
+func (h *txnHelper) isUnspent(addr stypes.UnlockHash, id stypes.SiacoinOutputID) bool {
+	return h.has(keyAddressUTXO(addr, id))
+}
+
+// isSiafundUnspent reports whether the siafund output id, controlled by addr,
+// is currently unspent.
+func (h *txnHelper) isSiafundUnspent(addr stypes.UnlockHash, id stypes.SiafundOutputID) bool {
+	return h.has(keySiafundAddressUTXO(addr, id))
+}
+
+// dbAddressTotals summarizes the unspent outputs controlled by an address,
+// allowing its balance to be computed without enumerating them. Siacoins
+// includes LockedSiacoins, the value of the address's delayed outputs.
+//
+// NOTE: a delayed output matures at the height it was created with (when it is
+// replaced by an ordinary siacoin output), so an output is locked precisely
+// when it is a delayed output.
+type dbAddressTotals struct {
+	SiacoinOutputs uint64
+	Siacoins       stypes.Currency
+	LockedSiacoins stypes.Currency
+	SiafundOutputs uint64
+	Siafunds       stypes.Currency
+}
+
+func (h *txnHelper) getAddressTotals(addr stypes.UnlockHash) (t dbAddressTotals) {
+	h.get(keyAddressTotals(addr), &t)
+	return
+}
+
+func (h *txnHelper) putAddressTotals(addr stypes.UnlockHash, t dbAddressTotals) {
+	if t.SiacoinOutputs == 0 && t.SiafundOutputs == 0 {
+		h.delete(keyAddressTotals(addr))
+	} else {
+		h.put(keyAddressTotals(addr), t)
+	}
+}
+
+// getIDs returns the IDs that follow keyPrefix in each key with that prefix.
+func (h *txnHelper) getIDs(keyPrefix []byte, n uint64) (ids [][32]byte) {
+	if h.err != nil {
+		return
+	}
+	ids = make([][32]byte, 0, n)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = keyPrefix
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var id [32]byte
+		copy(id[:], it.Item().Key()[len(keyPrefix):])
+		ids = append(ids, id)
+	}
+	return
+}
+
+// getAddressUTXOs returns the IDs of the unspent siacoin outputs controlled by
+// addr.
+func (h *txnHelper) getAddressUTXOs(addr stypes.UnlockHash) []stypes.SiacoinOutputID {
+	keyPrefix := append([]byte(prefixAddressUTXOs), addr[:]...)
+	ids := h.getIDs(keyPrefix, h.getAddressTotals(addr).SiacoinOutputs)
+	scoids := make([]stypes.SiacoinOutputID, len(ids))
+	for i := range ids {
+		scoids[i] = ids[i]
+	}
+	return scoids
+}
+
+// getAddressSiafundUTXOs returns the IDs of the unspent siafund outputs
+// controlled by addr.
+func (h *txnHelper) getAddressSiafundUTXOs(addr stypes.UnlockHash) []stypes.SiafundOutputID {
+	keyPrefix := append([]byte(prefixSiafundAddressUTXOs), addr[:]...)
+	ids := h.getIDs(keyPrefix, h.getAddressTotals(addr).SiafundOutputs)
+	sfoids := make([]stypes.SiafundOutputID, len(ids))
+	for i := range ids {
+		sfoids[i] = ids[i]
+	}
+	return sfoids
+}
+
+// dbBalance is the balance of an address as of a particular height.
+type dbBalance struct {
+	Siacoins stypes.Currency
+	Siafunds stypes.Currency
+}
+
+// balanceDelta tracks the changes to an address's balance within a block.
+// Additions and subtractions are tracked separately, since Currency cannot be
+// negative.
+type balanceDelta struct {
+	SiacoinsAdded   stypes.Currency
+	SiacoinsRemoved stypes.Currency
+	SiafundsAdded   stypes.Currency
+	SiafundsRemoved stypes.Currency
+}
+
+type balanceDeltas map[stypes.UnlockHash]*balanceDelta
+
+func (bd balanceDeltas) get(addr stypes.UnlockHash) *balanceDelta {
+	d, ok := bd[addr]
+	if !ok {
+		d = new(balanceDelta)
+		bd[addr] = d
+	}
+	return d
+}
+
+func (bd balanceDeltas) addSiacoins(addr stypes.UnlockHash, value stypes.Currency, credit bool) {
+	d := bd.get(addr)
+	if credit {
+		d.SiacoinsAdded = d.SiacoinsAdded.Add(value)
+	} else {
+		d.SiacoinsRemoved = d.SiacoinsRemoved.Add(value)
+	}
+}
+
+func (bd balanceDeltas) addSiafunds(addr stypes.UnlockHash, value stypes.Currency, credit bool) {
+	d := bd.get(addr)
+	if credit {
+		d.SiafundsAdded = d.SiafundsAdded.Add(value)
 	} else {
-		h.putBytes(keyAddress(addr), utxoBytes)
+		d.SiafundsRemoved = d.SiafundsRemoved.Add(value)
+	}
+}
+
+// getBalanceAt returns the balance of addr as of the specified height, i.e.
+// the most recent balance entry at or below height.
+func (h *txnHelper) getBalanceAt(addr stypes.UnlockHash, height stypes.BlockHeight) (bal dbBalance) {
+	if h.err != nil {
+		return
+	}
+	prefix := keyBalance(addr, 0)[:len("balances")+32]
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = prefix
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	it.Seek(keyBalance(addr, height))
+	if it.ValidForPrefix(prefix) {
+		h.err = it.Item().Value(func(val []byte) error {
+			return encoding.Unmarshal(val, &bal)
+		})
+	}
+	return
+}
+
+// putBalanceDeltas records the new balance of each address in bd as of the
+// specified height.
+func (h *txnHelper) putBalanceDeltas(height stypes.BlockHeight, bd balanceDeltas) {
+	for addr, d := range bd {
+		bal := h.getBalanceAt(addr, height)
+		bal.Siacoins = bal.Siacoins.Add(d.SiacoinsAdded).Sub(d.SiacoinsRemoved)
+		bal.Siafunds = bal.Siafunds.Add(d.SiafundsAdded).Sub(d.SiafundsRemoved)
+		h.put(keyBalance(addr, height), bal)
+	}
+}
+
+// deleteBalanceDeltas removes the balance entries recorded for each address
+// in bd at the specified height.
+func (h *txnHelper) deleteBalanceDeltas(height stypes.BlockHeight, bd balanceDeltas) {
+	for addr := range bd {
+		h.delete(keyBalance(addr, height))
+	}
+}
+
+func (h *txnHelper) getTxnLocation(txid crypto.Hash) (loc txnLocation) {
+	h.mustGet(keyTxn(txid), &loc)
+	return
+}
+
+// getTxnRefs returns all transactions associated with the specified address
+// or coin, most recent first.
+func (h *txnHelper) getTxnRefs(prefix string, id [32]byte) (refs []txnRef) {
+	if h.err != nil {
+		return
+	}
+	keyPrefix := append([]byte(prefix), id[:]...)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	opts.Prefix = keyPrefix
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	// seek past the end of the prefix
+	for it.Seek(append(keyPrefix, 0xFF)); it.ValidForPrefix(keyPrefix); it.Next() {
+		key := it.Item().Key()[len(keyPrefix):]
+		var ref txnRef
+		ref.Height = stypes.BlockHeight(binary.BigEndian.Uint64(key[:8]))
+		copy(ref.ID[:], key[8:])
+		refs = append(refs, ref)
 	}
+	return
+}
+
+// historyEntry is a transaction that affected an address, along with the
+// change in the address's balance.
+type historyEntry struct {
+	txnRef
+	Delta balanceDelta
+}
+
+// getAddressHistory returns up to limit entries from the history of addr,
+// most recent first, skipping the first offset entries. It also reports
+// whether more entries remain.
+func (h *txnHelper) getAddressHistory(addr stypes.UnlockHash, offset, limit int) (entries []historyEntry, more bool) {
+	if h.err != nil {
+		return
+	}
+	keyPrefix := append([]byte(prefixAddressTxns), addr[:]...)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = keyPrefix
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(append(keyPrefix, 0xFF)); it.ValidForPrefix(keyPrefix); it.Next() {
+		if offset > 0 {
+			offset--
+			continue
+		} else if len(entries) == limit {
+			return entries, true
+		}
+		key := it.Item().Key()[len(keyPrefix):]
+		var e historyEntry
+		e.Height = stypes.BlockHeight(binary.BigEndian.Uint64(key[:8]))
+		copy(e.ID[:], key[8:])
+		h.err = it.Item().Value(func(val []byte) error {
+			return encoding.Unmarshal(val, &e.Delta)
+		})
+		if h.err != nil {
+			return nil, false
+		}
+		entries = append(entries, e)
+	}
+	return entries, false
+}
+
+// indexBlock adds each transaction in the block to the transaction, address,
+// and coin indices.
+func (h *txnHelper) indexBlock(b stypes.Block, info blockInfo) {
+	bid := b.ID()
+	height := stypes.BlockHeight(info.Height)
+	for _, bt := range blockTxns(b, info) {
+		h.put(keyTxn(bt.ID), txnLocation{
+			BlockID: bid,
+			Height:  height,
+			Index:   bt.Index,
+		})
+		for addr, d := range bt.Deltas {
+			h.put(keyTxnRef(prefixAddressTxns, addr, height, bt.ID), *d)
+		}
+		for _, id := range bt.Coins {
+			h.putBytes(keyTxnRef(prefixCoinTxns, id, height, bt.ID), nil)
+		}
+	}
+}
+
+// unindexBlock reverses the effects of indexBlock.
+func (h *txnHelper) unindexBlock(b stypes.Block, info blockInfo) {
+	height := stypes.BlockHeight(info.Height)
+	for _, bt := range blockTxns(b, info) {
+		h.delete(keyTxn(bt.ID))
+		for addr := range bt.Deltas {
+			h.delete(keyTxnRef(prefixAddressTxns, addr, height, bt.ID))
+		}
+		for _, id := range bt.Coins {
+			h.delete(keyTxnRef(prefixCoinTxns, id, height, bt.ID))
+		}
+	}
+}
+
+// dbSubmission is a transaction set submitted via /construction/submit. The
+// submitted transaction is the last transaction in the set.
+type dbSubmission struct {
+	Set       []stypes.Transaction
+	Timestamp stypes.Timestamp
+	// set by rebroadcast when the set is first seen to be dropped, and
+	// cleared if it becomes pending again (i.e. if the conflicting
+	// transaction is reverted)
+	Dropped       bool
+	DroppedHeight stypes.BlockHeight
+}
+
+func (h *txnHelper) getSubmission(txid crypto.Hash) (sub dbSubmission, ok bool) {
+	ok = h.get(keySubmission(txid), &sub) && len(sub.Set) > 0
+	return
+}
+
+func (h *txnHelper) putSubmission(txid crypto.Hash, sub dbSubmission) {
+	h.put(keySubmission(txid), sub)
+}
+
+func (h *txnHelper) deleteSubmission(txid crypto.Hash) {
+	h.delete(keySubmission(txid))
+}
+
+// getSubmissions returns every submitted transaction set.
+func (h *txnHelper) getSubmissions() (subs []dbSubmission) {
+	if h.err != nil {
+		return
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixSubmissions)
+	it := h.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var sub dbSubmission
+		h.err = it.Item().Value(func(val []byte) error {
+			return encoding.Unmarshal(val, &sub)
+		})
+		if h.err != nil {
+			return nil
+		}
+		subs = append(subs, sub)
+	}
+	return
 }
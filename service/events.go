@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// EventsBlocks implements the /events/blocks endpoint.
+func (rs *RosettaService) EventsBlocks(ctx context.Context, request *rtypes.EventsBlocksRequest) (*rtypes.EventsBlocksResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
+	limit := uint64(defaultEventsLimit)
+	if request.Limit != nil && *request.Limit < maxEventsLimit {
+		limit = uint64(*request.Limit)
+	} else if request.Limit != nil {
+		limit = maxEventsLimit
+	}
+
+	var count, start uint64
+	var events []dbEvent
+	err := rs.dbView(func(h *txnHelper) {
+		count = h.getEventCount()
+		if request.Offset != nil {
+			start = uint64(*request.Offset)
+		} else if count > limit {
+			// return the most recent events
+			start = count - limit
+		}
+		if start >= count {
+			return
+		}
+		if start+limit > count {
+			limit = count - start
+		}
+		events = h.getEvents(start, limit)
+	})
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+
+	resp := &rtypes.EventsBlocksResponse{
+		Events: make([]*rtypes.BlockEvent, len(events)),
+	}
+	if count > 0 {
+		resp.MaxSequence = int64(count - 1)
+	}
+	for i, ev := range events {
+		typ := rtypes.ADDED
+		if ev.Removed {
+			typ = rtypes.REMOVED
+		}
+		resp.Events[i] = &rtypes.BlockEvent{
+			Sequence: int64(start) + int64(i),
+			BlockIdentifier: &rtypes.BlockIdentifier{
+				Index: int64(ev.Height),
+				Hash:  ev.BlockID.String(),
+			},
+			Type: typ,
+		}
+	}
+	return resp, nil
+}
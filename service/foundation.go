@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+)
+
+// dbFoundationSubsidy is a Foundation subsidy output created by the current
+// chain. Since Foundation address updates transfer subsidy outputs without
+// producing any diffs, the owner of each output is tracked explicitly.
+type dbFoundationSubsidy struct {
+	Owner          stypes.UnlockHash
+	Value          stypes.Currency
+	MaturityHeight stypes.BlockHeight
+}
+
+// foundationTransfer is a subsidy output transferred to the new primary
+// address by a Foundation address update.
+type foundationTransfer struct {
+	ID    stypes.SiacoinOutputID
+	From  stypes.UnlockHash
+	Value stypes.Currency
+}
+
+// foundationUpdate is the Foundation address update applied by a block.
+type foundationUpdate struct {
+	TxnIndex     uint64
+	NewPrimary   stypes.UnlockHash
+	NewFailsafe  stypes.UnlockHash
+	PriorPrimary stypes.UnlockHash
+	Transfers    []foundationTransfer
+}
+
+// parseFoundationUpdate returns the Foundation address update in b, along
+// with the index of the transaction containing it. As in consensus, only the
+// first update in a block is applied, and updates are ignored prior to the
+// Foundation hardfork.
+func parseFoundationUpdate(b stypes.Block, height stypes.BlockHeight) (index uint64, update stypes.FoundationUnlockHashUpdate, ok bool) {
+	if height < stypes.FoundationHardforkHeight {
+		return 0, update, false
+	}
+	for i, txn := range b.Transactions {
+		for _, arb := range txn.ArbitraryData {
+			if bytes.HasPrefix(arb, stypes.SpecifierFoundation[:]) && encoding.Unmarshal(arb[stypes.SpecifierLen:], &update) == nil {
+				return uint64(i), update, true
+			}
+		}
+	}
+	return 0, update, false
+}
+
+// transferFoundationSubsidies transfers every matured, unspent subsidy output
+// (other than those in exclude) to newPrimary, mirroring the transfer
+// performed by consensus when a Foundation address update is applied or
+// reverted at height.
+func (h *txnHelper) transferFoundationSubsidies(height stypes.BlockHeight, newPrimary stypes.UnlockHash, exclude map[stypes.SiacoinOutputID]bool) (transfers []foundationTransfer) {
+	ids, subsidies := h.getFoundationSubsidies()
+	for i, fs := range subsidies {
+		id := ids[i]
+		if fs.MaturityHeight >= height || exclude[id] || fs.Owner == newPrimary || !h.isUnspent(fs.Owner, id) {
+			continue
+		}
+		h.takeUTXO(fs.Owner, id, fs.Value, false)
+		h.giveUTXO(newPrimary, id, fs.Value, false)
+		transfers = append(transfers, foundationTransfer{id, fs.Owner, fs.Value})
+		fs.Owner = newPrimary
+		h.putFoundationSubsidy(id, fs)
+	}
+	return
+}
+
+// applyFoundationUpdate applies the Foundation address update (if any) in b,
+// which is being applied at height. It must be called before the diffs of b
+// are applied: consensus transfers the subsidy outputs when it reaches the
+// update, so outputs spent earlier in the block are not transferred, and
+// outputs spent later in the block are spent by the new primary address.
+func (h *txnHelper) applyFoundationUpdate(b stypes.Block, height stypes.BlockHeight) *foundationUpdate {
+	index, update, ok := parseFoundationUpdate(b, height)
+	if !ok {
+		return nil
+	}
+	spent := make(map[stypes.SiacoinOutputID]bool)
+	for _, txn := range b.Transactions[:index+1] {
+		for _, sci := range txn.SiacoinInputs {
+			spent[sci.ParentID] = true
+		}
+	}
+	fu := &foundationUpdate{
+		TxnIndex:     index,
+		NewPrimary:   update.NewPrimary,
+		NewFailsafe:  update.NewFailsafe,
+		PriorPrimary: h.getFoundationPrimary(),
+	}
+	fu.Transfers = h.transferFoundationSubsidies(height, update.NewPrimary, spent)
+	h.putFoundationPrimary(update.NewPrimary)
+	return fu
+}
+
+// revertFoundationUpdate reverts fu, which was applied at height. It must be
+// called after the diffs of the block are reverted.
+//
+// NOTE: like consensus, this transfers every matured, unspent subsidy output
+// to the prior primary address, which is not necessarily the address that
+// owned each output before the update was applied.
+func (h *txnHelper) revertFoundationUpdate(fu *foundationUpdate, height stypes.BlockHeight) {
+	h.transferFoundationSubsidies(height, fu.PriorPrimary, nil)
+	h.putFoundationPrimary(fu.PriorPrimary)
+}
+
+// putFoundationSubsidies records the Foundation subsidy created by b (if
+// any), or deletes it if b is being reverted.
+func (h *txnHelper) putFoundationSubsidies(b stypes.Block, diffs []modules.DelayedSiacoinOutputDiff, apply bool) {
+	id := b.ID().FoundationSubsidyID()
+	for _, diff := range diffs {
+		if diff.ID != id {
+			continue
+		} else if apply {
+			h.putFoundationSubsidy(id, dbFoundationSubsidy{
+				Owner:          diff.SiacoinOutput.UnlockHash,
+				Value:          diff.SiacoinOutput.Value,
+				MaturityHeight: diff.MaturityHeight,
+			})
+		} else {
+			h.deleteFoundationSubsidy(id)
+		}
+	}
+}
+
+// foundationUpdateOps returns the operations of a Foundation address update:
+// an operation on the new primary address, recording the new addresses in its
+// metadata, followed by a debit and credit for each transferred output.
+func foundationUpdateOps(index int, fu *foundationUpdate) []*rtypes.Operation {
+	update := &rtypes.Operation{
+		OperationIdentifier: &rtypes.OperationIdentifier{
+			Index: int64(index),
+		},
+		Type:   opTypeFoundationUpdate,
+		Status: rtypes.String("Applied"),
+		Account: &rtypes.AccountIdentifier{
+			Address: fu.NewPrimary.String(),
+		},
+		Metadata: map[string]interface{}{
+			"new_primary":   fu.NewPrimary.String(),
+			"new_failsafe":  fu.NewFailsafe.String(),
+			"prior_primary": fu.PriorPrimary.String(),
+		},
+	}
+	ops := []*rtypes.Operation{update}
+	related := []*rtypes.OperationIdentifier{update.OperationIdentifier}
+	for _, t := range fu.Transfers {
+		debit := newTransferOp(index+len(ops), t.From, t.ID.String(), convertAmount(t.Value, false), false)
+		credit := newTransferOp(index+len(ops)+1, fu.NewPrimary, t.ID.String(), convertAmount(t.Value, true), true)
+		for _, op := range []*rtypes.Operation{debit, credit} {
+			op.Type = opTypeFoundationUpdate
+			op.RelatedOperations = related
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coinbase/rosetta-sdk-go/asserter"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// AccountHistoryRequest is the request type for the /account/history
+// endpoint.
+type AccountHistoryRequest struct {
+	NetworkIdentifier *rtypes.NetworkIdentifier `json:"network_identifier"`
+	AccountIdentifier *rtypes.AccountIdentifier `json:"account_identifier"`
+	Offset            *int64                    `json:"offset,omitempty"`
+	Limit             *int64                    `json:"limit,omitempty"`
+}
+
+func (req *AccountHistoryRequest) network() *rtypes.NetworkIdentifier {
+	return req.NetworkIdentifier
+}
+
+func (req *AccountHistoryRequest) validate() error {
+	if err := asserter.AccountIdentifier(req.AccountIdentifier); err != nil {
+		return err
+	} else if req.Offset != nil && *req.Offset < 0 {
+		return asserter.ErrOffsetIsNegative
+	} else if req.Limit != nil && *req.Limit < 0 {
+		return asserter.ErrLimitIsNegative
+	}
+	return nil
+}
+
+// AccountHistoryEntry is a transaction that affected an account, along with
+// the net change in the account's balance of each currency.
+type AccountHistoryEntry struct {
+	BlockIdentifier       *rtypes.BlockIdentifier       `json:"block_identifier"`
+	TransactionIdentifier *rtypes.TransactionIdentifier `json:"transaction_identifier"`
+	Deltas                []*rtypes.Amount              `json:"deltas"`
+}
+
+// AccountHistoryResponse is the response type for the /account/history
+// endpoint.
+type AccountHistoryResponse struct {
+	BlockIdentifier *rtypes.BlockIdentifier `json:"block_identifier"`
+	Entries         []*AccountHistoryEntry  `json:"entries"`
+	NextOffset      *int64                  `json:"next_offset,omitempty"`
+}
+
+func netAmount(added, removed stypes.Currency, currency *rtypes.Currency) *rtypes.Amount {
+	if added.Cmp(removed) >= 0 {
+		return newAmount(added.Sub(removed), true, currency)
+	}
+	return newAmount(removed.Sub(added), false, currency)
+}
+
+// AccountHistory implements the /account/history endpoint. This endpoint is
+// not part of the Rosetta specification; it returns the transactions that
+// affected an account, most recent first.
+func (rs *RosettaService) AccountHistory(ctx context.Context, request *AccountHistoryRequest) (*AccountHistoryResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
+	uh, _, err := parseAccount(request.AccountIdentifier.Address)
+	if err != nil {
+		return nil, errInvalidAddress(err)
+	}
+	offset, limit := 0, defaultHistoryLimit
+	if request.Offset != nil {
+		offset = int(*request.Offset)
+	}
+	if request.Limit != nil && *request.Limit < maxHistoryLimit {
+		limit = int(*request.Limit)
+	} else if request.Limit != nil {
+		limit = maxHistoryLimit
+	}
+
+	resp := &AccountHistoryResponse{
+		Entries: []*AccountHistoryEntry{},
+	}
+	err = rs.dbView(func(h *txnHelper) {
+		resp.BlockIdentifier = &rtypes.BlockIdentifier{
+			Index: int64(h.getCurrentHeight()),
+			Hash:  h.getCurrentBlockID().String(),
+		}
+		entries, more := h.getAddressHistory(uh, offset, limit)
+		for _, e := range entries {
+			loc := h.getTxnLocation(e.ID)
+			resp.Entries = append(resp.Entries, &AccountHistoryEntry{
+				BlockIdentifier: &rtypes.BlockIdentifier{
+					Index: int64(e.Height),
+					Hash:  loc.BlockID.String(),
+				},
+				TransactionIdentifier: &rtypes.TransactionIdentifier{
+					Hash: e.ID.String(),
+				},
+				Deltas: []*rtypes.Amount{
+					netAmount(e.Delta.SiacoinsAdded, e.Delta.SiacoinsRemoved, currencySiacoin),
+					netAmount(e.Delta.SiafundsAdded, e.Delta.SiafundsRemoved, currencySiafund),
+				},
+			})
+		}
+		if more {
+			next := int64(offset + len(entries))
+			resp.NextOffset = &next
+		}
+	})
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	return resp, nil
+}
+
+// HistoryAPIController serves the /account/history endpoint.
+type HistoryAPIController struct {
+	rs       *RosettaService
+	asserter *asserter.Asserter
+}
+
+// NewHistoryAPIController returns a router for the /account/history endpoint.
+func NewHistoryAPIController(rs *RosettaService, a *asserter.Asserter) server.Router {
+	return &HistoryAPIController{
+		rs:       rs,
+		asserter: a,
+	}
+}
+
+// Routes implements server.Router.
+func (c *HistoryAPIController) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "AccountHistory",
+			Method:      http.MethodPost,
+			Pattern:     "/account/history",
+			HandlerFunc: c.AccountHistory,
+		},
+	}
+}
+
+// AccountHistory handles the /account/history endpoint.
+func (c *HistoryAPIController) AccountHistory(w http.ResponseWriter, r *http.Request) {
+	var request AccountHistoryRequest
+	serveEndpoint(w, r, c.asserter, &request, func() (interface{}, *rtypes.Error) {
+		return c.rs.AccountHistory(r.Context(), &request)
+	})
+}
@@ -2,14 +2,19 @@ package service
 
 import (
 	"context"
+	"sort"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 )
 
 // Mempool implements the /mempool endpoint.
 func (rs *RosettaService) Mempool(ctx context.Context, request *rtypes.NetworkRequest) (*rtypes.MempoolResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
 	txns := rs.tp.Transactions()
 	ids := make([]*rtypes.TransactionIdentifier, len(txns))
 	for i := range ids {
@@ -22,8 +27,126 @@ func (rs *RosettaService) Mempool(ctx context.Context, request *rtypes.NetworkRe
 	}, nil
 }
 
-// MempoolTransaction implements the /mempool/transaction endpoint.
+// unconfirmedOutputs indexes the outputs created and spent by a set of
+// unconfirmed transactions.
+type unconfirmedOutputs struct {
+	siacoin map[stypes.SiacoinOutputID]stypes.SiacoinOutput
+	siafund map[stypes.SiafundOutputID]stypes.SiafundOutput
+	creator map[crypto.Hash]int // output ID -> index of creating transaction
+	spent   map[crypto.Hash]bool
+}
+
+func newUnconfirmedOutputs(txns []stypes.Transaction) unconfirmedOutputs {
+	uo := unconfirmedOutputs{
+		siacoin: make(map[stypes.SiacoinOutputID]stypes.SiacoinOutput),
+		siafund: make(map[stypes.SiafundOutputID]stypes.SiafundOutput),
+		creator: make(map[crypto.Hash]int),
+		spent:   make(map[crypto.Hash]bool),
+	}
+	for i, txn := range txns {
+		for _, sci := range txn.SiacoinInputs {
+			uo.spent[crypto.Hash(sci.ParentID)] = true
+		}
+		for _, sfi := range txn.SiafundInputs {
+			uo.spent[crypto.Hash(sfi.ParentID)] = true
+		}
+		for j, sco := range txn.SiacoinOutputs {
+			id := txn.SiacoinOutputID(uint64(j))
+			uo.siacoin[id] = sco
+			uo.creator[crypto.Hash(id)] = i
+		}
+		for j, sfo := range txn.SiafundOutputs {
+			id := txn.SiafundOutputID(uint64(j))
+			uo.siafund[id] = sfo
+			uo.creator[crypto.Hash(id)] = i
+		}
+	}
+	return uo
+}
+
+// parents returns the indices of the transactions that txn (transitively)
+// depends upon, in the order they appear in the pool.
+func (uo unconfirmedOutputs) parents(txn stypes.Transaction, pool []stypes.Transaction) []int {
+	seen := make(map[int]bool)
+	var visit func(stypes.Transaction)
+	visit = func(txn stypes.Transaction) {
+		var ids []crypto.Hash
+		for _, sci := range txn.SiacoinInputs {
+			ids = append(ids, crypto.Hash(sci.ParentID))
+		}
+		for _, sfi := range txn.SiafundInputs {
+			ids = append(ids, crypto.Hash(sfi.ParentID))
+		}
+		for _, id := range ids {
+			if i, ok := uo.creator[id]; ok && !seen[i] {
+				seen[i] = true
+				visit(pool[i])
+			}
+		}
+	}
+	visit(txn)
+	indices := make([]int, 0, len(seen))
+	for i := range seen {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// ReceiveUpdatedUnconfirmedTransactions implements
+// modules.TransactionPoolSubscriber.
+func (rs *RosettaService) ReceiveUpdatedUnconfirmedTransactions(diff *modules.TransactionPoolDiff) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, id := range diff.RevertedTransactions {
+		delete(rs.txnSets, id)
+	}
+	for _, set := range diff.AppliedTransactions {
+		rs.txnSets[set.ID] = set.Transactions
+	}
+	var txns []stypes.Transaction
+	for _, set := range rs.txnSets {
+		txns = append(txns, set...)
+	}
+	rs.mempool = newUnconfirmedOutputs(txns)
+}
+
+// confirmedInputValues returns the values of the confirmed outputs spent by
+// txns, i.e. those not created by the transactions in uo.
+func confirmedInputValues(h *txnHelper, txns []stypes.Transaction, uo unconfirmedOutputs) inputValues {
+	values := make(inputValues)
+	for _, txn := range txns {
+		for _, sci := range txn.SiacoinInputs {
+			if _, ok := uo.siacoin[sci.ParentID]; !ok {
+				values[sci.ParentID] = h.getUTXO(sci.ParentID).Value
+			}
+		}
+		for _, sfi := range txn.SiafundInputs {
+			if _, ok := uo.siafund[sfi.ParentID]; !ok {
+				values[sfi.ParentID] = h.getSiafundUTXO(sfi.ParentID)
+			}
+		}
+	}
+	return values
+}
+
+// unconfirmedOutputs returns the outputs created and spent by the transactions
+// in the transaction pool. The returned value must not be modified.
+func (rs *RosettaService) unconfirmedOutputs() unconfirmedOutputs {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.mempool
+}
+
+// MempoolTransaction implements the /mempool/transaction endpoint. If the
+// transaction spends outputs created by other unconfirmed transactions, the
+// corresponding operations are marked as unconfirmed, and the transactions it
+// depends upon are returned in the "unconfirmed_parents" metadata field,
+// parents first.
 func (rs *RosettaService) MempoolTransaction(ctx context.Context, request *rtypes.MempoolTransactionRequest) (*rtypes.MempoolTransactionResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
 	var txid stypes.TransactionID
 	if err := (*crypto.Hash)(&txid).LoadString(request.TransactionIdentifier.Hash); err != nil {
 		return nil, errInvalidTxnID(err)
@@ -32,14 +155,33 @@ func (rs *RosettaService) MempoolTransaction(ctx context.Context, request *rtype
 	if !ok {
 		return nil, errUnknownTxn
 	}
-	var rtxn *rtypes.Transaction
+	// NOTE: the parents reported by the transaction pool are not used, as it
+	// fails to detect dependencies on unconfirmed siafund outputs
+	pool := rs.tp.Transactions()
+	uo := newUnconfirmedOutputs(pool)
+	txns := []stypes.Transaction{txn}
+	for _, i := range uo.parents(txn, pool) {
+		txns = append(txns, pool[i])
+	}
+	var values inputValues
 	err := rs.dbView(func(h *txnHelper) {
-		rtxn = convertTransaction(h, txn)
+		values = confirmedInputValues(h, txns, uo)
 	})
 	if err != nil {
 		return nil, errDatabase(err)
 	}
-	return &rtypes.MempoolTransactionResponse{
+	rtxn := convertTransaction(txn, values, uo)
+	var parents []*rtypes.Transaction
+	for _, parent := range txns[1:] {
+		parents = append(parents, convertTransaction(parent, values, uo))
+	}
+	resp := &rtypes.MempoolTransactionResponse{
 		Transaction: rtxn,
-	}, nil
+	}
+	if len(parents) > 0 {
+		resp.Metadata = map[string]interface{}{
+			"unconfirmed_parents": parents,
+		}
+	}
+	return resp, nil
 }
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+// dbVersion is the current version of the database schema. It must be
+// incremented whenever the layout or encoding of existing keys changes, and a
+// corresponding migration must be added to migrations.
+const dbVersion = "0.2.0"
+
+// A migration upgrades the database from one version to the next.
+type migration struct {
+	from, to string
+	// apply upgrades the database in place. Since the version is only updated
+	// after apply returns, apply must be safe to re-run if it is interrupted.
+	// If apply is nil, the database is instead rebuilt from scratch, i.e. the
+	// blockchain is reindexed.
+	apply func(db *badger.DB) error
+}
+
+// migrations lists every migration, in order.
+var migrations = []migration{
+	// version 0.1.0 (the original schema) stores the UTXOs of each address in
+	// a single list, and predates the siafund, balance, transaction, and event
+	// indices and the per-block records of spent outputs, none of which can be
+	// built from the database alone
+	{from: "0.1.0", to: "0.2.0"},
+}
+
+// compareVersions compares two dotted version strings, returning -1, 0, or 1.
+func compareVersions(a, b string) (int, error) {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for len(as) < len(bs) {
+		as = append(as, "0")
+	}
+	for len(bs) < len(as) {
+		bs = append(bs, "0")
+	}
+	for i := range as {
+		x, err := strconv.Atoi(as[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid version %q", a)
+		}
+		y, err := strconv.Atoi(bs[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid version %q", b)
+		}
+		if x < y {
+			return -1, nil
+		} else if x > y {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// initializeDB writes the initial state of an empty database.
+func initializeDB(h *txnHelper) {
+	h.putVersion(dbVersion)
+	h.putConsensusChangeID(modules.ConsensusChangeBeginning)
+	h.putCurrentHeight(^stypes.BlockHeight(0))
+	h.putCurrentBlockID(stypes.GenesisID)
+	h.putVoidBalance(stypes.ZeroCurrency)
+	h.putFoundationPrimary(stypes.InitialFoundationUnlockHash)
+}
+
+// reindexDB deletes the contents of the database and reinitializes it, causing
+// the blockchain to be reindexed when the service subscribes to the consensus
+// set.
+func reindexDB(db *badger.DB) error {
+	if err := db.DropAll(); err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		h := &txnHelper{txn: txn}
+		initializeDB(h)
+		return h.err
+	})
+}
+
+// migrateDB initializes the database if it is empty, and otherwise upgrades it
+// to dbVersion. If any of the required migrations is a reindex, the database
+// is reindexed without applying the others. Databases created by newer
+// versions of rosetta-sia are rejected.
+func migrateDB(db *badger.DB) error {
+	var version string
+	err := db.Update(func(txn *badger.Txn) error {
+		h := &txnHelper{txn: txn}
+		if version = h.getVersion(); version == "" {
+			log.Println("initializing db")
+			initializeDB(h)
+			version = dbVersion
+		}
+		return h.err
+	})
+	if err != nil {
+		return err
+	}
+	if cmp, err := compareVersions(version, dbVersion); err != nil {
+		return err
+	} else if cmp > 0 {
+		return fmt.Errorf("database version (%v) is newer than the version supported by this binary (%v)", version, dbVersion)
+	}
+
+	// determine the migrations required to reach dbVersion before applying
+	// any of them; if one requires a reindex, the others would be wasted
+	var path []migration
+	for _, m := range migrations {
+		if m.from == version {
+			path = append(path, m)
+			version = m.to
+		}
+	}
+	if version != dbVersion {
+		return fmt.Errorf("no migration from database version %v to %v", version, dbVersion)
+	}
+	for _, m := range path {
+		if m.apply == nil {
+			log.Printf("db version %v is incompatible with version %v; reindexing", path[0].from, dbVersion)
+			return reindexDB(db)
+		}
+	}
+
+	for _, m := range path {
+		log.Printf("migrating db from version %v to %v", m.from, m.to)
+		if err := m.apply(db); err != nil {
+			return fmt.Errorf("failed to migrate database from version %v to %v: %w", m.from, m.to, err)
+		}
+		err := db.Update(func(txn *badger.Txn) error {
+			h := &txnHelper{txn: txn}
+			h.putVersion(m.to)
+			return h.err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,11 +2,65 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"gitlab.com/NebulousLabs/Sia/build"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 )
 
+// networks
+
+// A Network is a Sia network that rosetta-sia can serve. Sia selects its
+// consensus parameters (genesis block, hardfork heights, maturity delay, etc.)
+// at compile time via build tags, so the network served by a binary is fixed
+// by the release it was built for; it cannot be chosen at runtime.
+type Network struct {
+	Name     string
+	BuildTag string // the tag required to build for this network, if any
+	Release  string // the corresponding build.Release
+}
+
+// Networks lists the supported networks. The version of Sia used by
+// rosetta-sia does not define any public testnets.
+var Networks = []Network{
+	{Name: "Mainnet", BuildTag: "", Release: "standard"},
+	{Name: "Devnet", BuildTag: "dev", Release: "dev"},
+}
+
+// NetworkIdentifier returns the identifier of the network that the binary was
+// built for. If expect is non-empty, it must name that network; this allows
+// deployments to guard against running a binary built for the wrong network.
+func NetworkIdentifier(expect string) (*rtypes.NetworkIdentifier, error) {
+	var built *Network
+	var names []string
+	for i, n := range Networks {
+		names = append(names, n.Name)
+		if n.Release == build.Release {
+			built = &Networks[i]
+		}
+	}
+	if built == nil {
+		return nil, fmt.Errorf("binary was built for the %q release, which does not correspond to a supported network", build.Release)
+	} else if expect != "" && !strings.EqualFold(expect, built.Name) {
+		for _, n := range Networks {
+			if strings.EqualFold(expect, n.Name) {
+				tags := "without release tags"
+				if n.BuildTag != "" {
+					tags = fmt.Sprintf("with -tags %v", n.BuildTag)
+				}
+				return nil, fmt.Errorf("expected network %v, but this binary serves %v (rebuild %v)", n.Name, built.Name, tags)
+			}
+		}
+		return nil, fmt.Errorf("unknown network %q (supported networks: %v)", expect, strings.Join(names, ", "))
+	}
+	return &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    built.Name,
+	}, nil
+}
+
 // errors
 
 func errorFn(code int32, retriable bool, msg string) func(error) *rtypes.Error {
@@ -35,17 +89,35 @@ var (
 	errInvalidBlockID          = errorFn(203, false, "invalid block ID")
 	errInvalidTxnID            = errorFn(204, false, "invalid transaction ID")
 	errInvalidTxn              = errorFn(205, false, "invalid transaction")
+	errInvalidSearch           = errorFn(206, false, "invalid search")
+	errInvalidSubAccount       = errorFn(207, false, "invalid sub-account")
+	errInvalidOptions          = errorFn(208, false, "invalid options")
+	errInvalidSignature        = errorFn(209, false, "invalid signature")
+	errInvalidSigningPayload   = errorFn(210, false, "invalid signing payload")
+	errMissingSignatures       = errorFn(211, false, "missing signatures")
+	errInvalidOperation        = errorFn(212, false, "invalid operation")
+	errUnsupportedCurrency     = errorFn(213, false, "unsupported currency")
+	errUnbalancedOperations    = errorFn(214, false, "operations do not balance")
 	errUnsupportedCurve        = errorFn(300, false, "unsupported curve")(nil)
 	errUnknownBlock            = errorFn(400, true, "unknown block")(nil)
 	errUnknownTxn              = errorFn(401, true, "unknown transaction")(nil)
 	errTxnNotAccepted          = errorFn(500, true, "transaction not accepted")
+	errOffline                 = errorFn(600, false, "endpoint unavailable in offline mode")(nil)
 )
 
 const (
-	opTypeInput    = "Input"
-	opTypeOutput   = "Output"
-	opTypeBlock    = "Block Reward"
-	opTypeContract = "File Contract Resolution"
+	opTypeInput             = "Input"
+	opTypeOutput            = "Output"
+	opTypeBlock             = "Block Reward"
+	opTypeContract          = "File Contract Resolution"
+	opTypeClaim             = "Siafund Claim"
+	opTypeContractFormation = "File Contract Formation"
+	opTypeContractRevision  = "File Contract Revision"
+	opTypeStorageProof      = "Storage Proof"
+	opTypeFee               = "Fee"
+	opTypeSiafundTax        = "Siafund Tax"
+	opTypeFoundationSubsidy = "Foundation Subsidy"
+	opTypeFoundationUpdate  = "Foundation Address Update"
 )
 
 var networkAllow = &rtypes.Allow{
@@ -60,6 +132,14 @@ var networkAllow = &rtypes.Allow{
 		opTypeOutput,
 		opTypeBlock,
 		opTypeContract,
+		opTypeClaim,
+		opTypeContractFormation,
+		opTypeContractRevision,
+		opTypeStorageProof,
+		opTypeFee,
+		opTypeSiafundTax,
+		opTypeFoundationSubsidy,
+		opTypeFoundationUpdate,
 	},
 	Errors: []*rtypes.Error{
 		errNotImplemented,
@@ -70,13 +150,31 @@ var networkAllow = &rtypes.Allow{
 		errInvalidBlockID(nil),
 		errInvalidTxnID(nil),
 		errInvalidTxn(nil),
+		errInvalidSearch(nil),
+		errInvalidSubAccount(nil),
+		errInvalidOptions(nil),
+		errInvalidSignature(nil),
+		errInvalidSigningPayload(nil),
+		errMissingSignatures(nil),
+		errInvalidOperation(nil),
+		errUnsupportedCurrency(nil),
+		errUnbalancedOperations(nil),
 		errUnsupportedCurve,
 		errUnknownBlock,
 		errUnknownTxn,
 		errTxnNotAccepted(nil),
+		errOffline,
 	},
 }
 
+// OperationTypes returns the operation types that may appear in the requests
+// and responses of the service.
+func OperationTypes() []string {
+	return append([]string(nil), networkAllow.OperationTypes...)
+}
+
+// NOTE: stypes.GenesisID depends on the build release, and thus identifies the
+// genesis block of the network the binary was built for.
 var genesisIdentifier = &rtypes.BlockIdentifier{
 	Index: 0,
 	Hash:  stypes.GenesisID.String(),
@@ -91,6 +189,9 @@ func (rs *RosettaService) NetworkList(ctx context.Context, request *rtypes.Metad
 
 // NetworkStatus implements the /network/status endpoint.
 func (rs *RosettaService) NetworkStatus(ctx context.Context, request *rtypes.NetworkRequest) (*rtypes.NetworkStatusResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
 	var bid stypes.BlockID
 	err := rs.dbView(func(h *txnHelper) { bid = h.getCurrentBlockID() })
 	if err != nil {
@@ -122,7 +223,7 @@ func (rs *RosettaService) NetworkOptions(ctx context.Context, request *rtypes.Ne
 	return &rtypes.NetworkOptionsResponse{
 		Version: &rtypes.Version{
 			RosettaVersion: "1.4.0",
-			NodeVersion:    "1.4.11",
+			NodeVersion:    "1.5.4",
 		},
 		Allow: networkAllow,
 	}, nil
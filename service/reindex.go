@@ -0,0 +1,131 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+// reindexProgressInterval is how often Reindex reports its progress.
+const reindexProgressInterval = 5 * time.Second
+
+// A reindexer replays the blocks of a consensus set into the database,
+// periodically logging its progress.
+type reindexer struct {
+	rs         *RosettaService
+	height     stypes.BlockHeight
+	target     stypes.BlockHeight
+	lastReport time.Time
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (r *reindexer) ProcessConsensusChange(cc modules.ConsensusChange) {
+	height, err := r.rs.applyConsensusChange(cc)
+	if err != nil {
+		log.Fatalln("Failed to update database:", err)
+	}
+	r.height = height
+	if time.Since(r.lastReport) >= reindexProgressInterval {
+		log.Printf("Reindexed %v of %v blocks (%.1f%%)", r.height+1, r.target+1, 100*float64(r.height+1)/float64(r.target+1))
+		r.lastReport = time.Now()
+	}
+}
+
+// openReindexDB opens the database within dir for reindexing. If the database
+// was being reindexed when a previous call to Reindex was interrupted, it is
+// reused; otherwise, it is deleted and replaced with an empty database. This
+// includes databases that cannot be opened or read, e.g. because they are
+// corrupted. However, a database that is locked (i.e. in use by a running
+// RosettaService) is left untouched, and an error is returned.
+func openReindexDB(dir string) (db *badger.DB, resumed bool, err error) {
+	if _, err := os.Stat(dir); err == nil {
+		db, err := openDB(dir)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, fmt.Errorf("database is in use: %w", err)
+		} else if err == nil {
+			err = db.View(func(txn *badger.Txn) error {
+				h := &txnHelper{txn: txn}
+				resumed = h.has(keyReindexing)
+				return h.err
+			})
+			if err == nil && resumed {
+				return db, true, nil
+			}
+			_ = db.Close()
+		}
+		if err != nil {
+			log.Println("WARN: existing database is unreadable:", err)
+		}
+		log.Println("Deleting existing database")
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, false, err
+		}
+	}
+	db, err = openDB(dir)
+	return db, false, err
+}
+
+// Reindex rebuilds the database within dir by replaying the blocks of cs,
+// starting from the genesis block. Any existing database is deleted, unless it
+// was left incomplete by an interrupted reindex, in which case the reindex
+// resumes where it left off, or it is in use, in which case Reindex returns an
+// error without modifying it. Closing cancel interrupts the reindex, causing
+// Reindex to return an error.
+func Reindex(cs modules.ConsensusSet, dir string, pruneDepth stypes.BlockHeight, cancel <-chan struct{}) error {
+	db, resumed, err := openReindexDB(dir)
+	if err != nil {
+		return err
+	}
+	if err := migrateDB(db); err != nil {
+		_ = db.Close()
+		return err
+	}
+	rs := &RosettaService{
+		db:         db,
+		pruneDepth: pruneDepth,
+	}
+	var ccid modules.ConsensusChangeID
+	var height stypes.BlockHeight
+	err = rs.dbUpdate(func(h *txnHelper) {
+		h.putBytes(keyReindexing, nil)
+		ccid = h.getConsensusChangeID()
+		height = h.getCurrentHeight()
+	})
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	r := &reindexer{
+		rs:         rs,
+		height:     height,
+		target:     cs.Height(),
+		lastReport: time.Now(),
+	}
+	if resumed {
+		log.Printf("Resuming reindex after %v of %v blocks", r.height+1, r.target+1)
+	} else {
+		log.Printf("Reindexing %v blocks", r.target+1)
+	}
+	if err := cs.ConsensusSetSubscribe(r, ccid, cancel); err != nil {
+		_ = db.Close()
+		return err
+	}
+	cs.Unsubscribe(r)
+	err = rs.dbUpdate(func(h *txnHelper) {
+		h.delete(keyReindexing)
+	})
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	log.Printf("Reindex complete at height %v (block %v)", r.height, cs.CurrentBlock().ID())
+	return db.Close()
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// searchQuery is a parsed SearchTransactionsRequest.
+type searchQuery struct {
+	txid     *crypto.Hash
+	addr     *stypes.UnlockHash
+	addrStr  string
+	coin     *crypto.Hash
+	typ      *string
+	currency *rtypes.Currency
+	status   *string
+	success  *bool
+}
+
+// opFilters reports whether the query contains any operation-level conditions
+// that cannot be answered from an index.
+func (q *searchQuery) opFilters() bool {
+	return q.typ != nil || q.currency != nil || q.status != nil || q.success != nil
+}
+
+// indexed reports whether every transaction returned by searchRefs satisfies
+// the query, in which case the query can be answered without converting the
+// transactions. This is not the case for "and" queries combining multiple
+// indexed conditions, since these must be satisfied by a single operation.
+func (q *searchQuery) indexed(and bool) bool {
+	if q.opFilters() {
+		return false
+	} else if !and {
+		return true
+	}
+	var n int
+	for _, ok := range []bool{q.txid != nil, q.coin != nil, q.addr != nil} {
+		if ok {
+			n++
+		}
+	}
+	return n == 1
+}
+
+func (q *searchQuery) matchOp(op *rtypes.Operation) bool {
+	if q.addr != nil && (op.Account == nil || op.Account.Address != q.addrStr) {
+		return false
+	}
+	if q.coin != nil && (op.CoinChange == nil || op.CoinChange.CoinIdentifier.Identifier != q.coin.String()) {
+		return false
+	}
+	if q.typ != nil && op.Type != *q.typ {
+		return false
+	}
+	if q.currency != nil && (op.Amount == nil || rtypes.Hash(op.Amount.Currency) != rtypes.Hash(q.currency)) {
+		return false
+	}
+	if q.status != nil && (op.Status == nil || *op.Status != *q.status) {
+		return false
+	}
+	if q.success != nil {
+		// all operations are successful
+		if !*q.success {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTxn reports whether the transaction satisfies every condition in the
+// query, i.e. whether it has the requested ID and contains a single operation
+// matching all of the operation-level conditions.
+func (q *searchQuery) matchTxn(txn *rtypes.Transaction) bool {
+	if q.txid != nil && txn.TransactionIdentifier.Hash != q.txid.String() {
+		return false
+	}
+	for _, op := range txn.Operations {
+		if q.matchOp(op) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSearchRequest(request *rtypes.SearchTransactionsRequest) (*searchQuery, *rtypes.Error) {
+	q := &searchQuery{
+		typ:      request.Type,
+		currency: request.Currency,
+		status:   request.Status,
+		success:  request.Success,
+	}
+	if request.TransactionIdentifier != nil {
+		q.txid = new(crypto.Hash)
+		if err := q.txid.LoadString(request.TransactionIdentifier.Hash); err != nil {
+			return nil, errInvalidTxnID(err)
+		}
+	}
+	addrStr := request.Address
+	if request.AccountIdentifier != nil {
+		if addrStr != nil && *addrStr != request.AccountIdentifier.Address {
+			return nil, errInvalidSearch(errors.New("address and account_identifier do not match"))
+		}
+		addrStr = &request.AccountIdentifier.Address
+	}
+	if addrStr != nil {
+		addr, _, err := parseAccount(*addrStr)
+		if err != nil {
+			return nil, errInvalidAddress(err)
+		}
+		q.addr, q.addrStr = &addr, *addrStr
+	}
+	if request.CoinIdentifier != nil {
+		q.coin = new(crypto.Hash)
+		if err := q.coin.LoadString(request.CoinIdentifier.Identifier); err != nil {
+			return nil, errInvalidSearch(err)
+		}
+	}
+	return q, nil
+}
+
+// searchRefs returns the set of transactions matching the indexed conditions
+// of the query. If and is true, only the most selective condition is used;
+// otherwise, the union of all conditions is returned.
+func searchRefs(h *txnHelper, q *searchQuery, and bool) []txnRef {
+	var refs []txnRef
+	if q.txid != nil {
+		var loc txnLocation
+		if h.get(keyTxn(*q.txid), &loc) {
+			refs = append(refs, txnRef{Height: loc.Height, ID: *q.txid})
+		}
+		if and {
+			return refs
+		}
+	}
+	if q.coin != nil {
+		refs = append(refs, h.getTxnRefs(prefixCoinTxns, *q.coin)...)
+		if and {
+			return refs
+		}
+	}
+	if q.addr != nil {
+		refs = append(refs, h.getTxnRefs(prefixAddressTxns, *q.addr)...)
+	}
+	return refs
+}
+
+// SearchTransactions implements the /search/transactions endpoint. Searches
+// must include at least one of transaction_identifier, coin_identifier, or
+// address (or account_identifier). When using the "or" operator, no other
+// conditions may be specified.
+func (rs *RosettaService) SearchTransactions(ctx context.Context, request *rtypes.SearchTransactionsRequest) (*rtypes.SearchTransactionsResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
+	q, rerr := parseSearchRequest(request)
+	if rerr != nil {
+		return nil, rerr
+	}
+	and := request.Operator == nil || *request.Operator == rtypes.AND
+	if q.txid == nil && q.coin == nil && q.addr == nil {
+		return nil, errInvalidSearch(errors.New("search must specify a transaction, coin, or address"))
+	} else if !and && q.opFilters() {
+		return nil, errInvalidSearch(errors.New("only transaction, coin, and address conditions may be combined with the 'or' operator"))
+	}
+	offset, limit := int64(0), int64(defaultSearchLimit)
+	if request.Offset != nil {
+		offset = *request.Offset
+	}
+	if request.Limit != nil && *request.Limit < maxSearchLimit {
+		limit = *request.Limit
+	} else if request.Limit != nil {
+		limit = maxSearchLimit
+	}
+
+	// if the indices alone determine the results, only the requested page of
+	// transactions is converted; otherwise, every candidate must be converted
+	// and matched before the page can be selected
+	indexed := q.indexed(and)
+	var matches []*rtypes.BlockTransaction
+	var total int64
+	var next *int64
+	err := rs.dbView(func(h *txnHelper) {
+		refs := searchRefs(h, q, and)
+		if h.err != nil {
+			return
+		}
+		// sort by height (most recent first) and remove duplicates
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].Height != refs[j].Height {
+				return refs[i].Height > refs[j].Height
+			}
+			return string(refs[i].ID[:]) < string(refs[j].ID[:])
+		})
+		unique := refs[:0]
+		for _, ref := range refs {
+			if len(unique) > 0 && ref == unique[len(unique)-1] {
+				continue
+			} else if request.MaxBlock != nil && int64(ref.Height) > *request.MaxBlock {
+				continue
+			}
+			unique = append(unique, ref)
+		}
+		refs = unique
+		if indexed {
+			var start, end int64
+			total = int64(len(refs))
+			start, end, next = searchPage(total, offset, limit)
+			refs = refs[start:end]
+		}
+
+		blocks := make(map[stypes.BlockID]stypes.Block)
+		for _, ref := range refs {
+			loc := h.getTxnLocation(ref.ID)
+			if h.err != nil {
+				return
+			}
+			b, ok := blocks[loc.BlockID]
+			if !ok {
+				if b, _, ok = rs.cs.BlockByID(loc.BlockID); !ok {
+					continue
+				}
+				blocks[loc.BlockID] = b
+			}
+			txn := blockTransaction(b, h.getBlockInfo(loc.BlockID), loc.Index)
+			if h.err != nil {
+				return
+			} else if and && !q.matchTxn(txn) {
+				continue
+			}
+			matches = append(matches, &rtypes.BlockTransaction{
+				BlockIdentifier: &rtypes.BlockIdentifier{
+					Index: int64(loc.Height),
+					Hash:  loc.BlockID.String(),
+				},
+				Transaction: txn,
+			})
+		}
+	})
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+
+	if !indexed {
+		var start, end int64
+		total = int64(len(matches))
+		start, end, next = searchPage(total, offset, limit)
+		matches = matches[start:end]
+	}
+	if matches == nil {
+		matches = []*rtypes.BlockTransaction{}
+	}
+	return &rtypes.SearchTransactionsResponse{
+		Transactions: matches,
+		TotalCount:   total,
+		NextOffset:   next,
+	}, nil
+}
+
+// searchPage returns the bounds of the requested page within n results, along
+// with the offset of the following page, if any.
+func searchPage(n, offset, limit int64) (start, end int64, next *int64) {
+	if offset >= n {
+		return n, n, nil
+	}
+	end = offset + limit
+	if end < n {
+		next = new(int64)
+		*next = end
+	} else {
+		end = n
+	}
+	return offset, end, next
+}
@@ -2,12 +2,12 @@ package service
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"github.com/dgraph-io/badger"
 	"gitlab.com/NebulousLabs/Sia/modules"
-	"gitlab.com/NebulousLabs/Sia/types"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
 )
 
@@ -18,6 +18,17 @@ type RosettaService struct {
 	cs modules.ConsensusSet
 	tp modules.TransactionPool
 	db *badger.DB
+
+	// outputs spent, and submissions confirmed, more than pruneDepth blocks
+	// ago are deleted from the database
+	pruneDepth stypes.BlockHeight
+
+	mu      sync.Mutex
+	txnSets map[modules.TransactionSetID][]stypes.Transaction
+	mempool unconfirmedOutputs
+
+	closed chan struct{}
+	bg     sync.WaitGroup
 }
 
 func (rs *RosettaService) dbUpdate(fn func(h *txnHelper)) error {
@@ -38,31 +49,88 @@ func (rs *RosettaService) dbView(fn func(h *txnHelper)) error {
 
 // ProcessConsensusChange implements modules.ConsensusSetSubscriber.
 func (rs *RosettaService) ProcessConsensusChange(cc modules.ConsensusChange) {
-	err := rs.dbUpdate(func(h *txnHelper) {
-		height := h.getCurrentHeight()
+	height, err := rs.applyConsensusChange(cc)
+	if err != nil {
+		log.Fatalln("Failed to update database:", err)
+	}
+	if cc.Synced {
+		log.Printf("Synced at height %v (block %v)", height, cc.AppliedBlocks[len(cc.AppliedBlocks)-1].ID())
+	} else if height%1000 == 0 {
+		log.Printf("Still syncing (current height: %v)", height)
+	}
+}
+
+// applyConsensusChange updates the database to reflect cc, returning the new
+// height of the blockchain.
+func (rs *RosettaService) applyConsensusChange(cc modules.ConsensusChange) (height stypes.BlockHeight, err error) {
+	err = rs.dbUpdate(func(h *txnHelper) {
+		height = h.getCurrentHeight()
 		for i, b := range cc.RevertedBlocks {
+			deltas := make(balanceDeltas)
 			for _, diff := range cc.RevertedDiffs[i].SiacoinOutputDiffs {
 				if diff.Direction == modules.DiffApply {
 					h.putUTXO(diff.ID, diff.SiacoinOutput.Value, 0)
-					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, false)
 				} else {
-					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, false)
 				}
+				deltas.addSiacoins(diff.SiacoinOutput.UnlockHash, diff.SiacoinOutput.Value, diff.Direction == modules.DiffApply)
 			}
 			for _, diff := range cc.RevertedDiffs[i].DelayedSiacoinOutputDiffs {
 				if diff.Direction == modules.DiffApply {
 					h.putUTXO(diff.ID, diff.SiacoinOutput.Value, diff.MaturityHeight)
-					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, true)
+				} else {
+					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, true)
+				}
+				deltas.addSiacoins(diff.SiacoinOutput.UnlockHash, diff.SiacoinOutput.Value, diff.Direction == modules.DiffApply)
+			}
+			for _, diff := range cc.RevertedDiffs[i].SiafundOutputDiffs {
+				if diff.Direction == modules.DiffApply {
+					h.putSiafundUTXO(diff.ID, diff.SiafundOutput.Value)
+					h.giveSiafundUTXO(diff.SiafundOutput.UnlockHash, diff.ID, diff.SiafundOutput.Value)
 				} else {
-					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.takeSiafundUTXO(diff.SiafundOutput.UnlockHash, diff.ID, diff.SiafundOutput.Value)
 				}
+				deltas.addSiafunds(diff.SiafundOutput.UnlockHash, diff.SiafundOutput.Value, diff.Direction == modules.DiffApply)
+			}
+			for _, diff := range cc.RevertedDiffs[i].FileContractDiffs {
+				deltas.addSiacoins(contractAccount(diff.ID), contractValue(diff.FileContract), diff.Direction == modules.DiffApply)
 			}
 
+			info := h.getBlockInfo(b.ID())
+			if tax, claimed := siafundPoolFlows(b, info); !tax.IsZero() || !claimed.IsZero() {
+				deltas.addSiacoins(siafundPoolAccount, tax, false)
+				deltas.addSiacoins(siafundPoolAccount, claimed, true)
+			}
+			h.putFoundationSubsidies(b, cc.RevertedDiffs[i].DelayedSiacoinOutputDiffs, false)
+			if fu := info.FoundationUpdate; fu != nil {
+				h.revertFoundationUpdate(fu, height)
+				for _, t := range fu.Transfers {
+					deltas.addSiacoins(t.From, t.Value, true)
+					deltas.addSiacoins(fu.NewPrimary, t.Value, false)
+				}
+			}
+
+			h.deleteBalanceDeltas(height, deltas)
+			h.unindexBlock(b, info)
+			h.deletePrunable(height)
+			h.appendEvent(dbEvent{BlockID: b.ID(), Height: height, Removed: true})
 			height--
 			h.deleteBlockInfo(b.ID())
 		}
 
 		for i, b := range cc.AppliedBlocks {
+			deltas := make(balanceDeltas)
+			// consensus applies Foundation updates before the block's
+			// maintenance (and without diffs), so this must precede the diffs
+			fu := h.applyFoundationUpdate(b, height+1)
+			if fu != nil {
+				for _, t := range fu.Transfers {
+					deltas.addSiacoins(t.From, t.Value, false)
+					deltas.addSiacoins(fu.NewPrimary, t.Value, true)
+				}
+			}
 			for _, diff := range cc.AppliedDiffs[i].DelayedSiacoinOutputDiffs {
 				// due to a consensus bug, a diff is created for the miner payout of
 				// the genesis block -- despite that output never actually existing.
@@ -72,73 +140,108 @@ func (rs *RosettaService) ProcessConsensusChange(cc modules.ConsensusChange) {
 				}
 				if diff.Direction == modules.DiffApply {
 					h.putUTXO(diff.ID, diff.SiacoinOutput.Value, diff.MaturityHeight)
-					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, true)
 				} else {
-					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, true)
 				}
+				deltas.addSiacoins(diff.SiacoinOutput.UnlockHash, diff.SiacoinOutput.Value, diff.Direction == modules.DiffApply)
 			}
 			for _, diff := range cc.AppliedDiffs[i].SiacoinOutputDiffs {
 				if diff.Direction == modules.DiffApply {
 					h.putUTXO(diff.ID, diff.SiacoinOutput.Value, 0)
-					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.giveUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, false)
 				} else {
-					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value)
+					h.takeUTXO(diff.SiacoinOutput.UnlockHash, diff.ID, diff.SiacoinOutput.Value, false)
 				}
+				deltas.addSiacoins(diff.SiacoinOutput.UnlockHash, diff.SiacoinOutput.Value, diff.Direction == modules.DiffApply)
+			}
+			for _, diff := range cc.AppliedDiffs[i].SiafundOutputDiffs {
+				if diff.Direction == modules.DiffApply {
+					h.putSiafundUTXO(diff.ID, diff.SiafundOutput.Value)
+					h.giveSiafundUTXO(diff.SiafundOutput.UnlockHash, diff.ID, diff.SiafundOutput.Value)
+				} else {
+					h.takeSiafundUTXO(diff.SiafundOutput.UnlockHash, diff.ID, diff.SiafundOutput.Value)
+				}
+				deltas.addSiafunds(diff.SiafundOutput.UnlockHash, diff.SiafundOutput.Value, diff.Direction == modules.DiffApply)
+			}
+			for _, diff := range cc.AppliedDiffs[i].FileContractDiffs {
+				deltas.addSiacoins(contractAccount(diff.ID), contractValue(diff.FileContract), diff.Direction == modules.DiffApply)
 			}
 
 			height++
+			h.putFoundationSubsidies(b, cc.AppliedDiffs[i].DelayedSiacoinOutputDiffs, true)
 			info := parseBlock(b, height, cc.AppliedDiffs[i])
+			info.FoundationUpdate = fu
+			if tax, claimed := siafundPoolFlows(b, info); !tax.IsZero() || !claimed.IsZero() {
+				deltas.addSiacoins(siafundPoolAccount, tax, true)
+				deltas.addSiacoins(siafundPoolAccount, claimed, false)
+			}
 			h.putBlockInfo(b.ID(), info)
+			h.putPrunable(height, b.ID())
+			h.indexBlock(b, info)
+			h.appendEvent(dbEvent{BlockID: b.ID(), Height: height})
+			h.putBalanceDeltas(height, deltas)
+		}
+		if height >= rs.pruneDepth {
+			h.pruneSpentOutputs(height - rs.pruneDepth)
 		}
 		h.putCurrentHeight(height)
 		h.putCurrentBlockID(cc.AppliedBlocks[len(cc.AppliedBlocks)-1].ID())
 		h.putConsensusChangeID(cc.ID)
-
-		if cc.Synced {
-			log.Printf("Synced at height %v (block %v)", height, cc.AppliedBlocks[len(cc.AppliedBlocks)-1].ID())
-		} else if height%1000 == 0 {
-			log.Printf("Still syncing (current height: %v)", height)
-		}
 	})
-	if err != nil {
-		log.Fatalln("Failed to update database:", err)
-	}
+	return
+}
+
+// offline reports whether the service was constructed without a node, in
+// which case only the offline endpoints are available.
+func (rs *RosettaService) offline() bool {
+	return rs.cs == nil
 }
 
 // Close shuts down the service.
 func (rs *RosettaService) Close() error {
+	if rs.offline() {
+		return nil
+	}
+	close(rs.closed)
+	rs.bg.Wait()
+	rs.tp.Unsubscribe(rs)
 	rs.cs.Unsubscribe(rs)
 	return rs.db.Close()
 }
 
+// DefaultPruneDepth is the default number of blocks after which spent outputs
+// are pruned from the database.
+const DefaultPruneDepth = 144
+
 // New constructs a RosettaService from the provided modules, storing its
-// database within dir.
-func New(ni *rtypes.NetworkIdentifier, g modules.Gateway, cs modules.ConsensusSet, tp modules.TransactionPool, dir string) (*RosettaService, error) {
-	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil).WithSyncWrites(false))
+// database within dir. Outputs spent more than pruneDepth blocks ago are
+// pruned from the database; since each block records the outputs it spends,
+// this does not affect the data served by the API.
+func New(ni *rtypes.NetworkIdentifier, g modules.Gateway, cs modules.ConsensusSet, tp modules.TransactionPool, dir string, pruneDepth stypes.BlockHeight) (*RosettaService, error) {
+	db, err := openDB(dir)
 	if err != nil {
 		return nil, err
 	}
 
 	rs := &RosettaService{
-		ni: ni,
-		db: db,
-		g:  g,
-		cs: cs,
-		tp: tp,
+		ni:         ni,
+		db:         db,
+		g:          g,
+		cs:         cs,
+		tp:         tp,
+		pruneDepth: pruneDepth,
+		txnSets:    make(map[modules.TransactionSetID][]stypes.Transaction),
+		closed:     make(chan struct{}),
 	}
 
-	// initialize (if necessary) and fetch CCID
+	// initialize or migrate (if necessary) and fetch CCID
+	if err := migrateDB(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 	var ccid modules.ConsensusChangeID
-	err = rs.dbUpdate(func(h *txnHelper) {
-		version := h.getVersion()
-		if version == "" {
-			log.Println("initializing db")
-			h.putVersion("0.1.0")
-			h.putConsensusChangeID(modules.ConsensusChangeBeginning)
-			h.putCurrentHeight(^types.BlockHeight(0))
-			h.putCurrentBlockID(stypes.GenesisID)
-			h.putVoidBalance(stypes.ZeroCurrency)
-		}
+	err = rs.dbView(func(h *txnHelper) {
 		ccid = h.getConsensusChangeID()
 	})
 	if err != nil {
@@ -150,10 +253,38 @@ func New(ni *rtypes.NetworkIdentifier, g modules.Gateway, cs modules.ConsensusSe
 		_ = db.Close()
 		return nil, err
 	}
+	// the database is now up-to-date, so an interrupted reindex (if any) has
+	// been completed
+	err = rs.dbUpdate(func(h *txnHelper) {
+		h.delete(keyReindexing)
+	})
+	if err != nil {
+		cs.Unsubscribe(rs)
+		_ = db.Close()
+		return nil, err
+	}
+	tp.TransactionPoolSubscribe(rs)
+	rs.bg.Add(1)
+	go rs.rebroadcastLoop()
 
 	return rs, nil
 }
 
+// NewOffline constructs a RosettaService that is not backed by a node or a
+// database. It serves the Construction API endpoints that do not require
+// blockchain state (derive, preprocess, payloads, parse, combine, and hash),
+// along with /network/list and /network/options; all other endpoints return
+// an error.
+func NewOffline(ni *rtypes.NetworkIdentifier) *RosettaService {
+	return &RosettaService{
+		ni: ni,
+	}
+}
+
+func openDB(dir string) (*badger.DB, error) {
+	return badger.Open(badger.DefaultOptions(dir).WithLogger(nil).WithSyncWrites(false))
+}
+
 func gcLoop(db *badger.DB) {
 	// check the db size once per minute, attempting garbage collection if the
 	// db has grown by 1 GB
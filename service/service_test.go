@@ -1,20 +1,33 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/coinbase/rosetta-sdk-go/asserter"
 	"github.com/coinbase/rosetta-sdk-go/keys"
 	"github.com/coinbase/rosetta-sdk-go/parser"
+	"github.com/coinbase/rosetta-sdk-go/server"
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/dgraph-io/badger"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/node"
 	stypes "gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
 )
 
 func TestDataAPI(t *testing.T) {
@@ -39,7 +52,9 @@ func TestDataAPI(t *testing.T) {
 		Blockchain: "Sia",
 		Network:    "Testnet",
 	}
-	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir)
+	// use the smallest non-zero prune depth, so that spent outputs are pruned
+	// promptly and the reorg below reverts blocks whose outputs were pruned
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,6 +103,21 @@ func TestDataAPI(t *testing.T) {
 		t.Error("expected current height to be to be 0, got", blockResp.Block.BlockIdentifier.Index)
 	}
 
+	// genesis siafunds should be reported
+	sfo := stypes.GenesisSiafundAllocation[0]
+	balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: sfo.UnlockHash.String(),
+		},
+		Currencies: []*rtypes.Currency{currencySiafund},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(balanceResp.Balances) != 1 || balanceResp.Balances[0].Value != sfo.Value.String() {
+		t.Fatal("expected genesis siafund balance of", sfo.Value, "got", balanceResp.Balances)
+	}
+
 	// mine a block, and request tip again
 	block, err := n.Miner.AddBlock()
 	if err != nil {
@@ -141,7 +171,7 @@ func TestDataAPI(t *testing.T) {
 	} else if _, err := n.Miner.AddBlock(); err != nil {
 		t.Fatal(err)
 	}
-	balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
 		NetworkIdentifier: ni,
 		BlockIdentifier:   &rtypes.PartialBlockIdentifier{},
 		AccountIdentifier: &rtypes.AccountIdentifier{
@@ -152,10 +182,185 @@ func TestDataAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	balance := balanceResp.Balances[0].Value
-	utxos := balanceResp.Coins
+	coinsResp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	utxos := coinsResp.Coins
 	if balance != tenSC.String() || len(utxos) != 1 || utxos[0].Amount.Value != balance {
 		t.Fatal("expected 1 utxo worth 10 SC, got", balance, utxos)
 	}
+	// each transaction should balance, with the fees collected by the block's
+	// payout transaction
+	tipResp, rerr := rs.Block(ctx, &rtypes.BlockRequest{
+		BlockIdentifier: &rtypes.PartialBlockIdentifier{},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	txns := tipResp.Block.Transactions
+	blockFees := new(big.Int)
+	for _, txn := range txns[:len(txns)-1] {
+		sum := new(big.Int)
+		for _, op := range txn.Operations {
+			v, _ := new(big.Int).SetString(op.Amount.Value, 10)
+			sum.Add(sum, v)
+			if op.Type == opTypeFee {
+				blockFees.Add(blockFees, v)
+			}
+		}
+		if sum.Sign() != 0 {
+			t.Fatal("expected transaction to balance, got", sum)
+		}
+	}
+	if blockFees.Sign() == 0 {
+		t.Fatal("expected wallet transaction to pay fees")
+	} else if op := txns[len(txns)-1].Operations[0]; op.Type != opTypeFee || op.Amount.Value != "-"+blockFees.String() {
+		t.Fatal("expected payout transaction to debit block fees, got", op)
+	}
+
+	// once another block is mined, the outputs spent by the tip block should
+	// be pruned, without affecting the block's transactions
+	if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	err = rs.dbView(func(h *txnHelper) {
+		for _, txn := range txns {
+			for _, op := range txn.Operations {
+				if op.Type != opTypeInput {
+					continue
+				}
+				var id stypes.SiacoinOutputID
+				if err := (*crypto.Hash)(&id).LoadString(op.CoinChange.CoinIdentifier.Identifier); err != nil {
+					t.Fatal(err)
+				} else if h.has(keyUTXO(id)) {
+					t.Error("expected spent output to be pruned:", id)
+				}
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prunedResp, rerr := rs.Block(ctx, &rtypes.BlockRequest{
+		BlockIdentifier: &rtypes.PartialBlockIdentifier{
+			Hash: &tipResp.Block.BlockIdentifier.Hash,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if !reflect.DeepEqual(prunedResp, tipResp) {
+		t.Fatal("block changed after its spent outputs were pruned")
+	}
+
+	// balance should be 0 prior to the send
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		BlockIdentifier: &rtypes.PartialBlockIdentifier{
+			Index: &blockResp.Block.BlockIdentifier.Index,
+		},
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if !reflect.DeepEqual(balanceResp.BlockIdentifier, blockResp.Block.BlockIdentifier) {
+		t.Fatal("expected historical balance to be reported at requested block")
+	} else if balanceResp.Balances[0].Value != "0" {
+		t.Fatal("expected historical balance of 0, got", balanceResp.Balances[0].Value)
+	}
+	// and 10 SC as of the tip, when requested by hash
+	tipHash := n.ConsensusSet.CurrentBlock().ID().String()
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		BlockIdentifier: &rtypes.PartialBlockIdentifier{
+			Hash: &tipHash,
+		},
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != tenSC.String() {
+		t.Fatal("expected historical balance of 10 SC, got", balanceResp.Balances[0].Value)
+	}
+
+	// the miner payout of the tip block should be locked until it matures
+	var payoutOp *rtypes.Operation
+	for _, op := range txns[len(txns)-1].Operations {
+		if op.Type == opTypeBlock {
+			payoutOp = op
+			break
+		}
+	}
+	if payoutOp == nil {
+		t.Fatal("expected payout transaction to contain a block reward")
+	}
+	subBalance := func(sub string) *big.Int {
+		resp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+			NetworkIdentifier: ni,
+			AccountIdentifier: &rtypes.AccountIdentifier{
+				Address:    payoutOp.Account.Address,
+				SubAccount: &rtypes.SubAccountIdentifier{Address: sub},
+			},
+			Currencies: []*rtypes.Currency{currencySiacoin},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		v, _ := new(big.Int).SetString(resp.Balances[0].Value, 10)
+		return v
+	}
+	payoutValue, _ := new(big.Int).SetString(payoutOp.Amount.Value, 10)
+	locked, spendable := subBalance(subAccountLocked), subBalance(subAccountSpendable)
+	if locked.Cmp(payoutValue) < 0 {
+		t.Fatalf("expected at least %v locked, got %v", payoutValue, locked)
+	}
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: payoutOp.Account.Address,
+		},
+		Currencies: []*rtypes.Currency{currencySiacoin},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if total := new(big.Int).Add(locked, spendable); balanceResp.Balances[0].Value != total.String() {
+		t.Fatalf("expected total balance of %v, got %v", total, balanceResp.Balances[0].Value)
+	} else if balanceResp.Metadata[subAccountLocked] != locked.String() {
+		t.Fatal("expected locked balance to be reported in metadata, got", balanceResp.Metadata)
+	}
+	coinsResp, rerr = rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: payoutOp.Account.Address,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	maturities := coinsResp.Metadata["maturity_heights"].(map[string]interface{})
+	expMaturity := stypes.BlockHeight(tipResp.Block.BlockIdentifier.Index) + stypes.MaturityDelay
+	if m := maturities[payoutOp.CoinChange.CoinIdentifier.Identifier]; m != expMaturity {
+		t.Fatalf("expected payout to mature at height %v, got %v", expMaturity, m)
+	}
+	_, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address:    payoutOp.Account.Address,
+			SubAccount: &rtypes.SubAccountIdentifier{Address: "foo"},
+		},
+	})
+	if rerr == nil || rerr.Code != errInvalidSubAccount(nil).Code {
+		t.Fatal("expected invalid sub-account error, got", rerr)
+	}
 
 	// test reorg handling sending some coins, then mining a longer chain on an
 	// unconnected node, then connecting them
@@ -171,7 +376,7 @@ func TestDataAPI(t *testing.T) {
 	} else if err = n2.Wallet.Unlock(masterKey); err != nil {
 		t.Fatal(err)
 	}
-	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay*2; i++ {
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay*2+1; i++ {
 		if _, err := n2.Miner.AddBlock(); err != nil {
 			t.Fatal(err)
 		}
@@ -224,10 +429,66 @@ func TestDataAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	balance = balanceResp.Balances[0].Value
-	utxos = balanceResp.Coins
+	coinsResp, rerr = rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	utxos = coinsResp.Coins
 	if balance != "0" || len(utxos) != 0 {
 		t.Fatal("expected 0 utxos, got", balance, utxos)
 	}
+	// event stream should contain the reverted blocks, ending with the new tip
+	eventsResp, rerr := rs.EventsBlocks(ctx, &rtypes.EventsBlocksRequest{
+		NetworkIdentifier: ni,
+		Offset:            rtypes.Int64(0),
+		Limit:             rtypes.Int64(1000),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if eventsResp.MaxSequence != int64(len(eventsResp.Events)-1) {
+		t.Fatal("expected all events to be returned")
+	} else if ev := eventsResp.Events[0]; ev.Type != rtypes.ADDED || ev.BlockIdentifier.Hash != stypes.GenesisID.String() {
+		t.Fatal("expected first event to add genesis block, got", ev)
+	} else if ev := eventsResp.Events[len(eventsResp.Events)-1]; ev.Type != rtypes.ADDED || ev.BlockIdentifier.Hash != statusResp.CurrentBlockIdentifier.Hash {
+		t.Fatal("expected last event to add current block, got", ev)
+	}
+	var removed int
+	for _, ev := range eventsResp.Events {
+		if ev.Type == rtypes.REMOVED {
+			removed++
+		}
+	}
+	if removed == 0 {
+		t.Fatal("expected reorg to produce removal events")
+	}
+	eventsResp, rerr = rs.EventsBlocks(ctx, &rtypes.EventsBlocksRequest{
+		NetworkIdentifier: ni,
+		Limit:             rtypes.Int64(1),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(eventsResp.Events) != 1 || eventsResp.Events[0].Sequence != eventsResp.MaxSequence {
+		t.Fatal("expected most recent event when offset is omitted")
+	}
+
+	// reverted blocks should no longer be queryable
+	_, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		BlockIdentifier: &rtypes.PartialBlockIdentifier{
+			Hash: &tipHash,
+		},
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != errUnknownBlock {
+		t.Fatal("expected unknown block error, got", rerr)
+	}
 }
 
 func TestConstructionAPI(t *testing.T) {
@@ -262,7 +523,7 @@ func TestConstructionAPI(t *testing.T) {
 		Blockchain: "Sia",
 		Network:    "Testnet",
 	}
-	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir)
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -309,7 +570,16 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	balance := balanceResp.Balances[0].Value
-	utxos := balanceResp.Coins
+	coinsResp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	utxos := coinsResp.Coins
 	if balance != tenSC.String() || len(utxos) != 1 || utxos[0].Amount.Value != balance {
 		t.Fatal("expected 1 utxo worth 10 SC, got", balance, utxos)
 	}
@@ -327,24 +597,43 @@ func TestConstructionAPI(t *testing.T) {
 		"public_key": hex.EncodeToString(keypair.PublicKey.Bytes),
 	}
 
-	// no-op
-	preprocessResp, rerr := rs.ConstructionPreprocess(ctx, &rtypes.ConstructionPreprocessRequest{
+	// the offline endpoints should be served by a service without a node
+	offline := NewOffline(ni)
+	defer offline.Close()
+	if _, rerr := offline.NetworkStatus(ctx, &rtypes.NetworkRequest{NetworkIdentifier: ni}); rerr != errOffline {
+		t.Fatal("expected offline error, got", rerr)
+	}
+
+	// estimate size
+	preprocessResp, rerr := offline.ConstructionPreprocess(ctx, &rtypes.ConstructionPreprocessRequest{
 		NetworkIdentifier: ni,
 		Operations:        ops,
 	})
 	if rerr != nil {
 		t.Fatal(rerr)
 	}
-	// no-op
+	// get suggested fee
 	metadataResp, rerr := rs.ConstructionMetadata(ctx, &rtypes.ConstructionMetadataRequest{
 		NetworkIdentifier: ni,
 		Options:           preprocessResp.Options,
 	})
 	if rerr != nil {
 		t.Fatal(rerr)
+	} else if len(metadataResp.SuggestedFee) != 1 || metadataResp.SuggestedFee[0].Currency.Symbol != currencySiacoin.Symbol {
+		t.Fatal("expected a siacoin fee suggestion, got", metadataResp.SuggestedFee)
+	}
+	var fee stypes.Currency
+	if _, err := fmt.Sscan(metadataResp.SuggestedFee[0].Value, &fee); err != nil {
+		t.Fatal(err)
+	} else if fee.IsZero() {
+		t.Fatal("expected non-zero suggested fee")
 	}
+	// pay the fee out of our change
+	change := fiveSC.Sub(fee)
+	ops[2] = transferOp(2, stypes.SiacoinOutput{UnlockHash: addr, Value: change}, stypes.SiacoinOutputID{}, true)
+	ops = append(ops, feeOp(3, fee, true))
 	// get payloads to sign
-	payloadsResp, rerr := rs.ConstructionPayloads(ctx, &rtypes.ConstructionPayloadsRequest{
+	payloadsResp, rerr := offline.ConstructionPayloads(ctx, &rtypes.ConstructionPayloadsRequest{
 		NetworkIdentifier: ni,
 		Operations:        ops,
 		Metadata:          metadataResp.Metadata,
@@ -353,7 +642,7 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	// validate (unsigned)
-	parseResp, rerr := rs.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
+	parseResp, rerr := offline.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
 		NetworkIdentifier: ni,
 		Transaction:       payloadsResp.UnsignedTransaction,
 		Signed:            false,
@@ -372,8 +661,28 @@ func TestConstructionAPI(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// invalid and duplicate signatures should be rejected
+	badSig := *sig
+	badSig.Bytes = append([]byte(nil), sig.Bytes...)
+	badSig.Bytes[0] ^= 1
+	for _, test := range []struct {
+		sigs []*rtypes.Signature
+		code int32
+	}{
+		{[]*rtypes.Signature{&badSig}, errInvalidSignature(nil).Code},
+		{[]*rtypes.Signature{sig, sig}, errInvalidSigningPayload(nil).Code},
+	} {
+		_, rerr := offline.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
+			NetworkIdentifier:   ni,
+			UnsignedTransaction: payloadsResp.UnsignedTransaction,
+			Signatures:          test.sigs,
+		})
+		if rerr == nil || rerr.Code != test.code {
+			t.Fatalf("expected error code %v, got %v", test.code, rerr)
+		}
+	}
 	// add signatures
-	combineResp, rerr := rs.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
+	combineResp, rerr := offline.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
 		NetworkIdentifier:   ni,
 		UnsignedTransaction: payloadsResp.UnsignedTransaction,
 		Signatures:          []*rtypes.Signature{sig},
@@ -382,7 +691,7 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	// validate (signed)
-	parseResp, rerr = rs.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
+	parseResp, rerr = offline.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
 		NetworkIdentifier: ni,
 		Transaction:       combineResp.SignedTransaction,
 		Signed:            true,
@@ -394,7 +703,7 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal("parsed ops do not match intended ops:", err)
 	}
 	// hash
-	hashResp, rerr := rs.ConstructionHash(ctx, &rtypes.ConstructionHashRequest{
+	hashResp, rerr := offline.ConstructionHash(ctx, &rtypes.ConstructionHashRequest{
 		NetworkIdentifier: ni,
 		SignedTransaction: combineResp.SignedTransaction,
 	})
@@ -402,6 +711,12 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	// submit
+	if _, rerr := offline.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
+		NetworkIdentifier: ni,
+		SignedTransaction: combineResp.SignedTransaction,
+	}); rerr != errOffline {
+		t.Fatal("expected offline error, got", rerr)
+	}
 	submitResp, rerr := rs.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
 		NetworkIdentifier: ni,
 		SignedTransaction: combineResp.SignedTransaction,
@@ -423,6 +738,22 @@ func TestConstructionAPI(t *testing.T) {
 	if !reflect.DeepEqual(mempoolResp.TransactionIdentifiers, []*rtypes.TransactionIdentifier{submitResp.TransactionIdentifier}) {
 		t.Fatal("mempool should contain constructed transaction")
 	}
+	// the spent coin should be omitted when the mempool is included
+	mempoolCoinsResp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+		IncludeMempool: true,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	for _, c := range mempoolCoinsResp.Coins {
+		if c.CoinIdentifier.Identifier == coinsResp.Coins[0].CoinIdentifier.Identifier {
+			t.Fatal("coin spent in mempool should not be reported")
+		}
+	}
 	transactionResp, rerr := rs.MempoolTransaction(ctx, &rtypes.MempoolTransactionRequest{
 		NetworkIdentifier:     ni,
 		TransactionIdentifier: submitResp.TransactionIdentifier,
@@ -464,6 +795,127 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal("expected error when requesting transaction not in mempool")
 	}
 
+	// transaction should be retrievable from the block
+	tip := n.ConsensusSet.CurrentBlock()
+	blockTxnResp, rerr := rs.BlockTransaction(ctx, &rtypes.BlockTransactionRequest{
+		NetworkIdentifier: ni,
+		BlockIdentifier: &rtypes.BlockIdentifier{
+			Index: int64(n.ConsensusSet.Height()),
+			Hash:  tip.ID().String(),
+		},
+		TransactionIdentifier: submitResp.TransactionIdentifier,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if !reflect.DeepEqual(blockTxnResp.Transaction.TransactionIdentifier, submitResp.TransactionIdentifier) {
+		t.Fatal("block transaction mismatch")
+	}
+
+	// search should return both the funding transaction and the constructed
+	// transaction, most recent first
+	searchResp, rerr := rs.SearchTransactions(ctx, &rtypes.SearchTransactionsRequest{
+		NetworkIdentifier: ni,
+		Address:           rtypes.String(addr.String()),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if searchResp.TotalCount != 2 || len(searchResp.Transactions) != 2 {
+		t.Fatal("expected 2 transactions, got", searchResp.TotalCount)
+	} else if !reflect.DeepEqual(searchResp.Transactions[0].Transaction.TransactionIdentifier, submitResp.TransactionIdentifier) {
+		t.Fatal("expected constructed transaction to be returned first")
+	}
+	searchResp, rerr = rs.SearchTransactions(ctx, &rtypes.SearchTransactionsRequest{
+		NetworkIdentifier: ni,
+		Address:           rtypes.String(addr.String()),
+		Type:              rtypes.String(opTypeInput),
+		Limit:             rtypes.Int64(1),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if searchResp.TotalCount != 1 || searchResp.NextOffset != nil {
+		t.Fatal("expected 1 transaction spending from address, got", searchResp.TotalCount)
+	}
+	searchResp, rerr = rs.SearchTransactions(ctx, &rtypes.SearchTransactionsRequest{
+		NetworkIdentifier: ni,
+		Address:           rtypes.String(addr.String()),
+		Offset:            rtypes.Int64(1),
+		Limit:             rtypes.Int64(1),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if searchResp.TotalCount != 2 || len(searchResp.Transactions) != 1 || searchResp.NextOffset != nil {
+		t.Fatal("expected second page to contain 1 of 2 transactions, got", len(searchResp.Transactions), "of", searchResp.TotalCount)
+	} else if reflect.DeepEqual(searchResp.Transactions[0].Transaction.TransactionIdentifier, submitResp.TransactionIdentifier) {
+		t.Fatal("expected funding transaction on second page")
+	}
+	searchResp, rerr = rs.SearchTransactions(ctx, &rtypes.SearchTransactionsRequest{
+		NetworkIdentifier: ni,
+		CoinIdentifier:    ops[0].CoinChange.CoinIdentifier,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if searchResp.TotalCount != 2 {
+		t.Fatal("expected coin to be created and spent, got", searchResp.TotalCount)
+	}
+
+	// history should reflect the net change of each transaction
+	historyResp, rerr := rs.AccountHistory(ctx, &AccountHistoryRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+		Limit: rtypes.Int64(1),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(historyResp.Entries) != 1 || historyResp.NextOffset == nil {
+		t.Fatal("expected 1 history entry with more remaining")
+	} else if historyResp.Entries[0].Deltas[0].Value != "-"+fiveSC.Add(fee).String() {
+		t.Fatal("expected delta of -(5 SC + fee), got", historyResp.Entries[0].Deltas[0].Value)
+	}
+	historyResp, rerr = rs.AccountHistory(ctx, &AccountHistoryRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+		Offset: historyResp.NextOffset,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(historyResp.Entries) != 1 || historyResp.NextOffset != nil {
+		t.Fatal("expected 1 history entry with none remaining")
+	} else if historyResp.Entries[0].Deltas[0].Value != tenSC.String() {
+		t.Fatal("expected delta of 10 SC, got", historyResp.Entries[0].Deltas[0].Value)
+	}
+	// the fee should be credited to the miner fees account, and debited by the
+	// payout transaction of the block, so that the account nets to zero
+	historyResp, rerr = rs.AccountHistory(ctx, &AccountHistoryRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: minerFeesAddress,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	feesNet := new(big.Int)
+	var feeCredited, feeDebited bool
+	for _, e := range historyResp.Entries {
+		v, _ := new(big.Int).SetString(e.Deltas[0].Value, 10)
+		feesNet.Add(feesNet, v)
+		switch e.TransactionIdentifier.Hash {
+		case submitResp.TransactionIdentifier.Hash:
+			feeCredited = v.Cmp(fee.Big()) == 0
+		case e.BlockIdentifier.Hash:
+			feeDebited = feeDebited || v.Sign() < 0
+		}
+	}
+	if !feeCredited || !feeDebited {
+		t.Fatal("expected fee to be credited and debited, got", historyResp.Entries)
+	} else if feesNet.Sign() != 0 {
+		t.Fatal("expected miner fees account to net to zero, got", feesNet)
+	}
+
 	// check balances
 	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
 		NetworkIdentifier: ni,
@@ -476,9 +928,18 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	balance = balanceResp.Balances[0].Value
-	utxos = balanceResp.Coins
-	if balance != fiveSC.String() || len(utxos) != 1 || utxos[0].Amount.Value != balance {
-		t.Fatal("expected 1 utxo worth 5 SC, got", balance, utxos)
+	coinsResp, rerr = rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	utxos = coinsResp.Coins
+	if balance != change.String() || len(utxos) != 1 || utxos[0].Amount.Value != balance {
+		t.Fatal("expected 1 utxo worth 5 SC minus fee, got", balance, utxos)
 	}
 	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
 		NetworkIdentifier: ni,
@@ -491,8 +952,1612 @@ func TestConstructionAPI(t *testing.T) {
 		t.Fatal(rerr)
 	}
 	balance = balanceResp.Balances[0].Value
-	utxos = balanceResp.Coins
+	coinsResp, rerr = rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	utxos = coinsResp.Coins
 	if balance != fiveSC.String() || len(utxos) != 1 || utxos[0].Amount.Value != balance {
 		t.Fatal("expected 1 utxo worth 5 SC, got", balance, utxos)
 	}
 }
+
+func TestFileContracts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	// mine enough to get spendable coins
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay; i++ {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	// form a contract that will expire without a storage proof
+	height := n.ConsensusSet.Height()
+	payout := stypes.SiacoinPrecision.Mul64(10)
+	value := stypes.PostTax(height, payout)
+	void := stypes.UnlockHash{1, 2, 3}
+	fc := stypes.FileContract{
+		WindowStart:        height + 2,
+		WindowEnd:          height + 4,
+		Payout:             payout,
+		ValidProofOutputs:  []stypes.SiacoinOutput{{Value: value, UnlockHash: void}},
+		MissedProofOutputs: []stypes.SiacoinOutput{{Value: value, UnlockHash: void}},
+	}
+	builder, err := n.Wallet.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := builder.FundSiacoins(payout); err != nil {
+		t.Fatal(err)
+	}
+	builder.AddFileContract(fc)
+	txnSet, err := builder.Sign(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := n.TransactionPool.AcceptTransactionSet(txnSet); err != nil {
+		t.Fatal(err)
+	} else if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	fcid := txnSet[len(txnSet)-1].FileContractID(0)
+
+	// contract should hold its post-tax value
+	ctx := context.Background()
+	balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: fcid.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != value.String() {
+		t.Fatal("expected contract balance of", value, "got", balanceResp.Balances[0].Value)
+	}
+	// the siafund tax should be held by the siafund pool
+	tax := payout.Sub(value)
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: siafundPoolAddress,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != tax.String() {
+		t.Fatal("expected siafund pool balance of", tax, "got", balanceResp.Balances[0].Value)
+	}
+
+	// mine until the contract expires
+	for n.ConsensusSet.Height() <= fc.WindowEnd {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	balanceResp, rerr = rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: fcid.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != "0" {
+		t.Fatal("expected contract balance of 0, got", balanceResp.Balances[0].Value)
+	}
+
+	// the contract should have been formed and resolved
+	searchResp, rerr := rs.SearchTransactions(ctx, &rtypes.SearchTransactionsRequest{
+		NetworkIdentifier: ni,
+		Address:           rtypes.String(fcid.String()),
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if searchResp.TotalCount != 2 {
+		t.Fatal("expected 2 transactions, got", searchResp.TotalCount)
+	}
+	var resolution, formation *rtypes.Operation
+	for _, op := range searchResp.Transactions[0].Transaction.Operations {
+		if op.Type == opTypeContract && op.Account.Address == fcid.String() {
+			resolution = op
+		}
+	}
+	var taxOp *rtypes.Operation
+	sum := new(big.Int)
+	for _, op := range searchResp.Transactions[1].Transaction.Operations {
+		if op.Type == opTypeContractFormation {
+			formation = op
+		} else if op.Type == opTypeSiafundTax {
+			taxOp = op
+		}
+		v, _ := new(big.Int).SetString(op.Amount.Value, 10)
+		sum.Add(sum, v)
+	}
+	if formation == nil || formation.Amount.Value != value.String() {
+		t.Fatal("expected formation operation crediting", value, "got", formation)
+	} else if taxOp == nil || taxOp.Account.Address != siafundPoolAddress || taxOp.Amount.Value != tax.String() {
+		t.Fatal("expected tax operation crediting", tax, "got", taxOp)
+	} else if sum.Sign() != 0 {
+		t.Fatal("expected contract-forming transaction to balance, got", sum)
+	} else if resolution == nil || resolution.Amount.Value != "-"+value.String() || resolution.Metadata["valid"] != false {
+		t.Fatal("expected missed resolution operation debiting", value, "got", resolution)
+	}
+}
+
+func TestFoundation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	ctx := context.Background()
+	mineUntil := func(height stypes.BlockHeight) {
+		for n.ConsensusSet.Height() < height {
+			if _, err := n.Miner.AddBlock(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	blockOps := func(height stypes.BlockHeight, typ string) (ops []*rtypes.Operation) {
+		index := int64(height)
+		blockResp, rerr := rs.Block(ctx, &rtypes.BlockRequest{
+			NetworkIdentifier: ni,
+			BlockIdentifier: &rtypes.PartialBlockIdentifier{
+				Index: &index,
+			},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		for _, txn := range blockResp.Block.Transactions {
+			for _, op := range txn.Operations {
+				if op.Type == typ {
+					ops = append(ops, op)
+				}
+			}
+		}
+		return
+	}
+	balance := func(addr stypes.UnlockHash) string {
+		balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+			NetworkIdentifier: ni,
+			AccountIdentifier: &rtypes.AccountIdentifier{
+				Address: addr.String(),
+			},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		return balanceResp.Balances[0].Value
+	}
+
+	// the hardfork block should pay the initial subsidy to the primary address
+	mineUntil(stypes.FoundationHardforkHeight)
+	ops := blockOps(stypes.FoundationHardforkHeight, opTypeFoundationSubsidy)
+	if len(ops) != 1 {
+		t.Fatal("expected 1 subsidy operation, got", len(ops))
+	} else if ops[0].Account.Address != stypes.InitialFoundationUnlockHash.String() || ops[0].Amount.Value != stypes.InitialFoundationSubsidy.String() {
+		t.Fatal("expected subsidy operation crediting", stypes.InitialFoundationSubsidy, "got", ops[0])
+	}
+	hardforkBlock, _ := n.ConsensusSet.BlockAtHeight(stypes.FoundationHardforkHeight)
+	initialID := hardforkBlock.ID().FoundationSubsidyID()
+	if ops[0].CoinChange.CoinIdentifier.Identifier != initialID.String() {
+		t.Fatal("expected subsidy coin", initialID, "got", ops[0].CoinChange.CoinIdentifier.Identifier)
+	}
+
+	// mine until the next subsidy has matured, then spend the initial subsidy
+	// in a transaction that updates the primary address
+	subsidy := stypes.FoundationSubsidyPerBlock.Mul64(uint64(stypes.FoundationSubsidyFrequency))
+	nextHeight := stypes.FoundationHardforkHeight + stypes.FoundationSubsidyFrequency
+	mineUntil(nextHeight + stypes.MaturityDelay)
+	ops = blockOps(nextHeight, opTypeFoundationSubsidy)
+	if len(ops) != 1 || ops[0].Amount.Value != subsidy.String() {
+		t.Fatal("expected subsidy operation crediting", subsidy, "got", ops)
+	}
+	nextID := ops[0].CoinChange.CoinIdentifier.Identifier
+	if bal := balance(stypes.InitialFoundationUnlockHash); bal != stypes.InitialFoundationSubsidy.Add(subsidy).String() {
+		t.Fatal("expected primary balance of", stypes.InitialFoundationSubsidy.Add(subsidy), "got", bal)
+	}
+
+	newPrimary := stypes.UnlockHash{4, 5, 6}
+	void := stypes.UnlockHash{1, 2, 3}
+	primaryUC, primaryKeys := stypes.GenerateDeterministicMultisig(2, 3, stypes.InitialFoundationTestingSalt)
+	txn := stypes.Transaction{
+		SiacoinInputs: []stypes.SiacoinInput{{
+			ParentID:         initialID,
+			UnlockConditions: primaryUC,
+		}},
+		SiacoinOutputs: []stypes.SiacoinOutput{{
+			Value:      stypes.InitialFoundationSubsidy,
+			UnlockHash: void,
+		}},
+		ArbitraryData: [][]byte{encoding.MarshalAll(stypes.SpecifierFoundation, stypes.FoundationUnlockHashUpdate{
+			NewPrimary:  newPrimary,
+			NewFailsafe: stypes.InitialFoundationFailsafeUnlockHash,
+		})},
+		TransactionSignatures: make([]stypes.TransactionSignature, primaryUC.SignaturesRequired),
+	}
+	for i := range txn.TransactionSignatures {
+		txn.TransactionSignatures[i].ParentID = crypto.Hash(initialID)
+		txn.TransactionSignatures[i].CoveredFields = stypes.FullCoveredFields
+		txn.TransactionSignatures[i].PublicKeyIndex = uint64(i)
+		sig := crypto.SignHash(txn.SigHash(i, n.ConsensusSet.Height()), primaryKeys[i])
+		txn.TransactionSignatures[i].Signature = sig[:]
+	}
+	block, target, err := n.Miner.BlockForWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Transactions = append(block.Transactions, txn)
+	block, _ = n.Miner.SolveBlock(block, target)
+	if err := n.ConsensusSet.AcceptBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// the update should transfer the matured subsidy, but not the spent one
+	ops = blockOps(n.ConsensusSet.Height(), opTypeFoundationUpdate)
+	if len(ops) != 3 {
+		t.Fatal("expected 3 update operations, got", len(ops))
+	} else if ops[0].Metadata["new_primary"] != newPrimary.String() || ops[0].Metadata["prior_primary"] != stypes.InitialFoundationUnlockHash.String() {
+		t.Fatal("expected update operation recording new primary, got", ops[0].Metadata)
+	} else if ops[1].Account.Address != stypes.InitialFoundationUnlockHash.String() || ops[1].CoinChange.CoinIdentifier.Identifier != nextID || ops[1].Amount.Value != "-"+subsidy.String() {
+		t.Fatal("expected transfer debiting", subsidy, "got", ops[1])
+	} else if ops[2].Account.Address != newPrimary.String() || ops[2].CoinChange.CoinIdentifier.Identifier != nextID || ops[2].Amount.Value != subsidy.String() {
+		t.Fatal("expected transfer crediting", subsidy, "got", ops[2])
+	}
+	if bal := balance(stypes.InitialFoundationUnlockHash); bal != "0" {
+		t.Fatal("expected prior primary balance of 0, got", bal)
+	} else if bal := balance(newPrimary); bal != subsidy.String() {
+		t.Fatal("expected new primary balance of", subsidy, "got", bal)
+	}
+
+	// subsequent subsidies should be paid to the new primary address
+	nextHeight += stypes.FoundationSubsidyFrequency
+	for nextHeight <= n.ConsensusSet.Height() {
+		nextHeight += stypes.FoundationSubsidyFrequency
+	}
+	mineUntil(nextHeight)
+	ops = blockOps(nextHeight, opTypeFoundationSubsidy)
+	if len(ops) != 1 || ops[0].Account.Address != newPrimary.String() {
+		t.Fatal("expected subsidy operation crediting new primary, got", ops)
+	}
+	coinsResp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: newPrimary.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(coinsResp.Coins) != 2 {
+		t.Fatal("expected 2 coins, got", len(coinsResp.Coins))
+	}
+}
+
+func TestMultisigConstruction(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	// mine enough to get spendable coins
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay; i++ {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	// create a 2-of-3 multisig address and send 10 SC to it
+	var keypairs []*keys.KeyPair
+	var uc stypes.UnlockConditions
+	for i := 0; i < 3; i++ {
+		kp, err := keys.GenerateKeypair(rtypes.Edwards25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keypairs = append(keypairs, kp)
+		uc.PublicKeys = append(uc.PublicKeys, stypes.SiaPublicKey{
+			Algorithm: stypes.SignatureEd25519,
+			Key:       kp.PublicKey.Bytes,
+		})
+	}
+	uc.SignaturesRequired = 2
+	addr := uc.UnlockHash()
+	// derive should produce the same address
+	ctx := context.Background()
+	deriveResp, rerr := rs.ConstructionDerive(ctx, &rtypes.ConstructionDeriveRequest{
+		NetworkIdentifier: ni,
+		PublicKey:         keypairs[1].PublicKey,
+		Metadata: map[string]interface{}{
+			"public_keys": []string{
+				hex.EncodeToString(keypairs[0].PublicKey.Bytes),
+				hex.EncodeToString(keypairs[1].PublicKey.Bytes),
+				hex.EncodeToString(keypairs[2].PublicKey.Bytes),
+			},
+			"signatures_required": 2,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if deriveResp.AccountIdentifier.Address != addr.String() {
+		t.Fatal("derived address does not match multisig address")
+	} else if !reflect.DeepEqual(deriveResp.Metadata["unlock_conditions"], uc) {
+		t.Fatal("derived unlock conditions do not match", deriveResp.Metadata)
+	}
+	tenSC := stypes.SiacoinPrecision.Mul64(10)
+	if _, err := n.Wallet.SendSiacoins(tenSC, addr); err != nil {
+		t.Fatal(err)
+	} else if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	coinsResp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: addr.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(coinsResp.Coins) != 1 {
+		t.Fatal("expected 1 coin, got", len(coinsResp.Coins))
+	}
+
+	// spend it to the void, signing with the first and third keys
+	void := stypes.UnlockHash{1, 2, 3}
+	ops := []*rtypes.Operation{
+		transferOp(0, stypes.SiacoinOutput{UnlockHash: addr, Value: tenSC}, stypes.SiacoinOutputID{}, false),
+		transferOp(1, stypes.SiacoinOutput{UnlockHash: void, Value: tenSC}, stypes.SiacoinOutputID{}, true),
+	}
+	ops[0].CoinChange.CoinIdentifier = coinsResp.Coins[0].CoinIdentifier
+	ops[0].Metadata = map[string]interface{}{
+		"unlock_conditions":  uc,
+		"public_key_indices": []uint64{0, 2},
+	}
+	metadataResp, rerr := rs.ConstructionMetadata(ctx, &rtypes.ConstructionMetadataRequest{
+		NetworkIdentifier: ni,
+		Options:           map[string]interface{}{"estimated_size": 0.0},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	payloadsResp, rerr := rs.ConstructionPayloads(ctx, &rtypes.ConstructionPayloadsRequest{
+		NetworkIdentifier: ni,
+		Operations:        ops,
+		Metadata:          metadataResp.Metadata,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(payloadsResp.Payloads) != 2 {
+		t.Fatal("expected 2 payloads, got", len(payloadsResp.Payloads))
+	}
+	var sigs []*rtypes.Signature
+	for i, kp := range []*keys.KeyPair{keypairs[0], keypairs[2]} {
+		p := payloadsResp.Payloads[i]
+		if !reflect.DeepEqual(p.AccountIdentifier, signerAccount(uc.PublicKeys[[]int{0, 2}[i]])) {
+			t.Fatal("payload has wrong signer:", p.AccountIdentifier)
+		}
+		sig, err := (&keys.SignerEdwards25519{KeyPair: kp}).Sign(p, rtypes.Ed25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	// combining only one signature should produce a partially signed
+	// transaction, which reports the other as missing and cannot be submitted
+	partialResp, rerr := rs.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
+		NetworkIdentifier:   ni,
+		UnsignedTransaction: payloadsResp.UnsignedTransaction,
+		Signatures:          sigs[:1],
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	parseResp, rerr := rs.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
+		NetworkIdentifier: ni,
+		Transaction:       partialResp.SignedTransaction,
+		Signed:            true,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if err := parser.ExpectedSigners(payloadsResp.Payloads[:1], parseResp.AccountIdentifierSigners); err != nil {
+		t.Fatal("parsed signers do not match signed payloads:", err)
+	} else if missing, _ := parseResp.Metadata["missing_payloads"].([]*rtypes.SigningPayload); len(missing) != 1 || !reflect.DeepEqual(missing[0], payloadsResp.Payloads[1]) {
+		t.Fatal("expected second payload to be reported missing, got", parseResp.Metadata)
+	}
+	if _, rerr := rs.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
+		NetworkIdentifier: ni,
+		SignedTransaction: partialResp.SignedTransaction,
+	}); rerr == nil || rerr.Code != errMissingSignatures(nil).Code {
+		t.Fatal("expected missing signatures error, got", rerr)
+	} else if missing := rerr.Details["missing_payloads"].([]*rtypes.SigningPayload); len(missing) != 1 || !reflect.DeepEqual(missing[0], payloadsResp.Payloads[1]) {
+		t.Fatal("expected second payload to be reported missing, got", missing)
+	}
+	// the remaining signature can then be combined separately
+	combineResp, rerr := rs.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
+		NetworkIdentifier:   ni,
+		UnsignedTransaction: partialResp.SignedTransaction,
+		Signatures:          sigs[1:],
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	parseResp, rerr = rs.ConstructionParse(ctx, &rtypes.ConstructionParseRequest{
+		NetworkIdentifier: ni,
+		Transaction:       combineResp.SignedTransaction,
+		Signed:            true,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if err := parser.ExpectedSigners(payloadsResp.Payloads, parseResp.AccountIdentifierSigners); err != nil {
+		t.Fatal("parsed signers do not match payloads:", err)
+	} else if parseResp.Metadata != nil {
+		t.Fatal("expected no missing payloads, got", parseResp.Metadata)
+	}
+	if _, rerr := rs.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
+		NetworkIdentifier: ni,
+		SignedTransaction: combineResp.SignedTransaction,
+	}); rerr != nil {
+		t.Fatal(rerr)
+	} else if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: void.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != tenSC.String() {
+		t.Fatal("expected void balance of 10 SC, got", balanceResp.Balances[0].Value)
+	}
+
+	// a mismatched key index should be rejected
+	ops[0].Metadata["public_key_indices"] = []uint64{0, 3}
+	if _, rerr := rs.ConstructionPayloads(ctx, &rtypes.ConstructionPayloadsRequest{
+		NetworkIdentifier: ni,
+		Operations:        ops,
+	}); rerr == nil || rerr.Code != errInvalidUnlockConditions(nil).Code {
+		t.Fatal("expected invalid unlock conditions error, got", rerr)
+	}
+
+	// derive a timelocked address and send 10 SC to it
+	timelock := n.ConsensusSet.Height() + 3
+	deriveResp, rerr = rs.ConstructionDerive(ctx, &rtypes.ConstructionDeriveRequest{
+		NetworkIdentifier: ni,
+		PublicKey:         keypairs[0].PublicKey,
+		Metadata: map[string]interface{}{
+			"timelock": timelock,
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	lockedUC := standardUnlockConditions(keypairs[0].PublicKey.Bytes)
+	lockedUC.Timelock = timelock
+	if deriveResp.AccountIdentifier.Address != lockedUC.UnlockHash().String() {
+		t.Fatal("derived address does not match timelocked address")
+	}
+	if _, err := n.Wallet.SendSiacoins(tenSC, lockedUC.UnlockHash()); err != nil {
+		t.Fatal(err)
+	} else if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	coinsResp, rerr = rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: deriveResp.AccountIdentifier,
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if len(coinsResp.Coins) != 1 {
+		t.Fatal("expected 1 coin, got", len(coinsResp.Coins))
+	}
+	ops = []*rtypes.Operation{
+		transferOp(0, stypes.SiacoinOutput{UnlockHash: lockedUC.UnlockHash(), Value: tenSC}, stypes.SiacoinOutputID{}, false),
+		transferOp(1, stypes.SiacoinOutput{UnlockHash: void, Value: tenSC}, stypes.SiacoinOutputID{}, true),
+	}
+	ops[0].CoinChange.CoinIdentifier = coinsResp.Coins[0].CoinIdentifier
+	ops[0].Metadata = deriveResp.Metadata
+
+	// spending should be rejected until the timelock expires
+	payloadsFor := func() (*rtypes.ConstructionPayloadsResponse, *rtypes.Error) {
+		metadataResp, rerr := rs.ConstructionMetadata(ctx, &rtypes.ConstructionMetadataRequest{
+			NetworkIdentifier: ni,
+			Options:           map[string]interface{}{"estimated_size": 0.0},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		return rs.ConstructionPayloads(ctx, &rtypes.ConstructionPayloadsRequest{
+			NetworkIdentifier: ni,
+			Operations:        ops,
+			Metadata:          metadataResp.Metadata,
+		})
+	}
+	if _, rerr := payloadsFor(); rerr == nil || rerr.Code != errInvalidUnlockConditions(nil).Code {
+		t.Fatal("expected timelocked input to be rejected, got", rerr)
+	}
+	for n.ConsensusSet.Height() < timelock {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payloadsResp, rerr = payloadsFor()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	sig, err := (&keys.SignerEdwards25519{KeyPair: keypairs[0]}).Sign(payloadsResp.Payloads[0], rtypes.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combineResp, rerr = rs.ConstructionCombine(ctx, &rtypes.ConstructionCombineRequest{
+		NetworkIdentifier:   ni,
+		UnsignedTransaction: payloadsResp.UnsignedTransaction,
+		Signatures:          []*rtypes.Signature{sig},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if _, rerr := rs.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
+		NetworkIdentifier: ni,
+		SignedTransaction: combineResp.SignedTransaction,
+	}); rerr != nil {
+		t.Fatal(rerr)
+	}
+}
+
+func TestMalformedConstructionRequests(t *testing.T) {
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs := NewOffline(ni)
+	keypair, err := keys.GenerateKeypair(rtypes.Edwards25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := standardUnlockConditions(keypair.PublicKey.Bytes).UnlockHash()
+	validInput := func() *rtypes.Operation {
+		op := transferOp(0, stypes.SiacoinOutput{UnlockHash: addr, Value: stypes.SiacoinPrecision}, stypes.SiacoinOutputID{1}, false)
+		op.Metadata = map[string]interface{}{
+			"public_key": hex.EncodeToString(keypair.PublicKey.Bytes),
+		}
+		return op
+	}
+	output := transferOp(1, stypes.SiacoinOutput{UnlockHash: addr, Value: stypes.SiacoinPrecision}, stypes.SiacoinOutputID{}, true)
+
+	tests := []struct {
+		desc   string
+		modify func(op *rtypes.Operation)
+		code   int32
+	}{
+		{"nil amount", func(op *rtypes.Operation) { op.Amount = nil }, errInvalidOperation(nil).Code},
+		{"nil account", func(op *rtypes.Operation) { op.Account = nil }, errInvalidOperation(nil).Code},
+		{"nil coin change", func(op *rtypes.Operation) { op.CoinChange = nil }, errInvalidOperation(nil).Code},
+		{"bad coin", func(op *rtypes.Operation) { op.CoinChange.CoinIdentifier.Identifier = "foo" }, errInvalidOperation(nil).Code},
+		{"unknown type", func(op *rtypes.Operation) { op.Type = "Transfer" }, errInvalidOperation(nil).Code},
+		{"positive input", func(op *rtypes.Operation) { op.Amount.Value = op.Amount.Value[1:] }, errInvalidOperation(nil).Code},
+		{"bad amount", func(op *rtypes.Operation) { op.Amount.Value = "-1e24" }, errInvalidAmount(nil).Code},
+		{"bad decimals", func(op *rtypes.Operation) { op.Amount.Currency = &rtypes.Currency{Symbol: "SC", Decimals: 8} }, errUnsupportedCurrency(nil).Code},
+		{"bad currency", func(op *rtypes.Operation) { op.Amount.Currency = &rtypes.Currency{Symbol: "BTC", Decimals: 8} }, errUnsupportedCurrency(nil).Code},
+		{"bad address", func(op *rtypes.Operation) { op.Account.Address = "foo" }, errInvalidAddress(nil).Code},
+		{"missing key", func(op *rtypes.Operation) { op.Metadata = nil }, errInvalidUnlockConditions(nil).Code},
+		{"non-string key", func(op *rtypes.Operation) { op.Metadata["public_key"] = 7 }, errInvalidUnlockConditions(nil).Code},
+		{"wrong key", func(op *rtypes.Operation) { op.Metadata["public_key"] = hex.EncodeToString(make([]byte, 32)) }, errInvalidUnlockConditions(nil).Code},
+		{"siacoin claim", func(op *rtypes.Operation) { op.Metadata["claim_address"] = addr.String() }, errInvalidOperation(nil).Code},
+		{"created input", func(op *rtypes.Operation) { op.CoinChange.CoinAction = rtypes.CoinCreated }, errInvalidOperation(nil).Code},
+	}
+	for _, test := range tests {
+		op := validInput()
+		test.modify(op)
+		_, rerr := rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+			NetworkIdentifier: ni,
+			Operations:        []*rtypes.Operation{op, output},
+		})
+		if rerr == nil || rerr.Code != test.code {
+			t.Errorf("%v: expected error code %v, got %v", test.desc, test.code, rerr)
+		} else if rerr.Details["operation_index"] != 0 {
+			t.Errorf("%v: expected error to identify operation 0, got %v", test.desc, rerr.Details)
+		}
+	}
+	payloadsResp, rerr := rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+		NetworkIdentifier: ni,
+		Operations:        []*rtypes.Operation{validInput(), output},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	// signing payloads should depend on the supplied height
+	for _, height := range []stypes.BlockHeight{stypes.ASICHardforkHeight - 2, stypes.ASICHardforkHeight + 10, stypes.FoundationHardforkHeight + 10} {
+		resp, rerr := rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+			NetworkIdentifier: ni,
+			Operations:        []*rtypes.Operation{validInput(), output},
+			Metadata:          map[string]interface{}{"height": height},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		txn, err := decodeTxn(resp.UnsignedTransaction)
+		if err != nil {
+			t.Fatal(err)
+		} else if txn.TargetHeight != height+1 {
+			t.Fatalf("expected target height %v, got %v", height+1, txn.TargetHeight)
+		}
+		sigHash := txn.SigHash(0, height+1)
+		if !bytes.Equal(resp.Payloads[0].Bytes, sigHash[:]) {
+			t.Fatal("signing payload does not match sighash at target height")
+		}
+		preFork := height+1 < stypes.FoundationHardforkHeight
+		if preFork == bytes.Equal(resp.Payloads[0].Bytes, payloadsResp.Payloads[0].Bytes) {
+			t.Fatal("only pre-hardfork payloads should differ from the default", height)
+		}
+	}
+
+	// parents must be valid transactions, and should be carried by the
+	// resulting transaction, ancestors first
+	if _, rerr := rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+		NetworkIdentifier: ni,
+		Operations:        []*rtypes.Operation{validInput(), output},
+		Metadata:          map[string]interface{}{"parents": []string{"foo"}},
+	}); rerr == nil || rerr.Code != errInvalidOptions(nil).Code {
+		t.Fatal("expected invalid options error, got", rerr)
+	}
+	parent, err := decodeTxn(payloadsResp.UnsignedTransaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandparent := stypes.Transaction{ArbitraryData: [][]byte{{1}}}
+	parent.Parents = []stypes.Transaction{grandparent}
+	payloadsResp, rerr = rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+		NetworkIdentifier: ni,
+		Operations:        []*rtypes.Operation{validInput(), output},
+		Metadata: map[string]interface{}{
+			"parents": []string{base64.StdEncoding.EncodeToString(encoding.Marshal(parent))},
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	txn, err := decodeTxn(payloadsResp.UnsignedTransaction)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(txn.Parents) != 2 || txn.Parents[0].ID() != grandparent.ID() || txn.Parents[1].ID() != parent.ID() {
+		t.Fatal("transaction does not carry its parents", txn.Parents)
+	}
+
+	// inputs must exactly cover outputs and fees in /construction/payloads,
+	// but may exceed them in /construction/preprocess
+	fee := feeOp(2, stypes.SiacoinPrecision, true)
+	for _, ops := range [][]*rtypes.Operation{
+		{validInput()},
+		{validInput(), output, fee},
+	} {
+		if _, rerr := rs.ConstructionPayloads(context.Background(), &rtypes.ConstructionPayloadsRequest{
+			NetworkIdentifier: ni,
+			Operations:        ops,
+		}); rerr == nil || rerr.Code != errUnbalancedOperations(nil).Code {
+			t.Fatal("expected unbalanced operations error, got", rerr)
+		}
+	}
+	if _, rerr := rs.ConstructionPreprocess(context.Background(), &rtypes.ConstructionPreprocessRequest{
+		NetworkIdentifier: ni,
+		Operations:        []*rtypes.Operation{validInput()},
+	}); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	// malformed transactions should be rejected, rather than causing a panic
+	for _, test := range []struct {
+		desc   string
+		modify func(txn *constructionTxn)
+	}{
+		{"missing input parents", func(txn *constructionTxn) { txn.InputParents = nil }},
+		{"extra siafund input parents", func(txn *constructionTxn) { txn.SiafundInputParents = make([]stypes.SiafundOutput, 1) }},
+		{"partial covered fields", func(txn *constructionTxn) {
+			txn.TransactionSignatures[0].CoveredFields = stypes.CoveredFields{SiacoinInputs: []uint64{99}}
+		}},
+		{"extra covered fields", func(txn *constructionTxn) {
+			txn.TransactionSignatures[0].CoveredFields.TransactionSignatures = []uint64{99}
+		}},
+	} {
+		txn, err := decodeTxn(payloadsResp.UnsignedTransaction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(&txn)
+		encoded := base64.StdEncoding.EncodeToString(encoding.Marshal(txn))
+		if _, rerr := rs.ConstructionParse(context.Background(), &rtypes.ConstructionParseRequest{
+			NetworkIdentifier: ni,
+			Transaction:       encoded,
+		}); rerr == nil || rerr.Code != errInvalidTxn(nil).Code {
+			t.Errorf("%v: expected invalid transaction error from parse, got %v", test.desc, rerr)
+		}
+		if _, rerr := rs.ConstructionCombine(context.Background(), &rtypes.ConstructionCombineRequest{
+			NetworkIdentifier:   ni,
+			UnsignedTransaction: encoded,
+		}); rerr == nil || rerr.Code != errInvalidTxn(nil).Code {
+			t.Errorf("%v: expected invalid transaction error from combine, got %v", test.desc, rerr)
+		}
+	}
+}
+
+func TestEndpointControllers(t *testing.T) {
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	a, err := asserter.NewServer(OperationTypes(), true, []*rtypes.NetworkIdentifier{ni}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := server.NewRouter(
+		NewHistoryAPIController(NewOffline(ni), a),
+		NewStatusAPIController(NewOffline(ni), a),
+	)
+	post := func(path string, request interface{}) (int, *rtypes.Error) {
+		t.Helper()
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		var rerr rtypes.Error
+		if w.Code != http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&rerr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, &rerr
+	}
+
+	account := &rtypes.AccountIdentifier{Address: stypes.UnlockHash{}.String()}
+	txid := &rtypes.TransactionIdentifier{Hash: stypes.TransactionID{}.String()}
+	for _, test := range []struct {
+		desc    string
+		path    string
+		request interface{}
+		errMsg  string
+	}{
+		{
+			desc:    "unsupported network",
+			path:    "/account/history",
+			request: AccountHistoryRequest{NetworkIdentifier: &rtypes.NetworkIdentifier{Blockchain: "Sia", Network: "Mainnet"}, AccountIdentifier: account},
+		},
+		{
+			desc:    "negative offset",
+			path:    "/account/history",
+			request: AccountHistoryRequest{NetworkIdentifier: ni, AccountIdentifier: account, Offset: rtypes.Int64(-1)},
+			errMsg:  asserter.ErrOffsetIsNegative.Error(),
+		},
+		{
+			desc:    "missing transaction identifier",
+			path:    "/construction/status",
+			request: ConstructionStatusRequest{NetworkIdentifier: ni},
+		},
+		{
+			desc:    "offline history",
+			path:    "/account/history",
+			request: AccountHistoryRequest{NetworkIdentifier: ni, AccountIdentifier: account},
+			errMsg:  errOffline.Message,
+		},
+		{
+			desc:    "offline status",
+			path:    "/construction/status",
+			request: ConstructionStatusRequest{NetworkIdentifier: ni, TransactionIdentifier: txid},
+			errMsg:  errOffline.Message,
+		},
+	} {
+		code, rerr := post(test.path, test.request)
+		if code != http.StatusInternalServerError {
+			t.Errorf("%v: expected status %v, got %v", test.desc, http.StatusInternalServerError, code)
+		} else if rerr.Message == "" || (test.errMsg != "" && rerr.Message != test.errMsg) {
+			t.Errorf("%v: unexpected error %q", test.desc, rerr.Message)
+		}
+	}
+}
+
+func TestUnconfirmedTransactions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	// mine enough to get spendable coins
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay; i++ {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	// send 10 SC to an address, but don't mine the transaction
+	sk, pk := crypto.GenerateKeyPair()
+	uc := standardUnlockConditions(pk[:])
+	tenSC := stypes.SiacoinPrecision.Mul64(10)
+	parents, err := n.Wallet.SendSiacoins(tenSC, uc.UnlockHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parentID stypes.SiacoinOutputID
+	for _, txn := range parents {
+		for i, sco := range txn.SiacoinOutputs {
+			if sco.UnlockHash == uc.UnlockHash() {
+				parentID = txn.SiacoinOutputID(uint64(i))
+			}
+		}
+	}
+
+	// the output should only be reported if the mempool is included
+	ctx := context.Background()
+	coins := func(includeMempool bool) *rtypes.AccountCoinsResponse {
+		t.Helper()
+		resp, rerr := rs.AccountCoins(ctx, &rtypes.AccountCoinsRequest{
+			NetworkIdentifier: ni,
+			AccountIdentifier: &rtypes.AccountIdentifier{
+				Address: uc.UnlockHash().String(),
+			},
+			IncludeMempool: includeMempool,
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		return resp
+	}
+	if resp := coins(false); len(resp.Coins) != 0 {
+		t.Fatal("unconfirmed coin should not be reported", resp.Coins)
+	} else if _, ok := resp.Metadata["unconfirmed_coins"]; ok {
+		t.Fatal("unconfirmed coins should not be reported", resp.Metadata)
+	}
+	if resp := coins(true); len(resp.Coins) != 1 || resp.Coins[0].CoinIdentifier.Identifier != parentID.String() {
+		t.Fatal("expected unconfirmed coin, got", resp.Coins)
+	} else if !reflect.DeepEqual(resp.Metadata["unconfirmed_coins"], []string{parentID.String()}) {
+		t.Fatal("coin should be marked as unconfirmed", resp.Metadata)
+	}
+	balanceResp, rerr := rs.AccountBalance(ctx, &rtypes.AccountBalanceRequest{
+		NetworkIdentifier: ni,
+		AccountIdentifier: &rtypes.AccountIdentifier{
+			Address: uc.UnlockHash().String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if balanceResp.Balances[0].Value != "0" {
+		t.Fatal("confirmed balance should be zero, got", balanceResp.Balances[0].Value)
+	} else if balanceResp.Metadata["pending_siacoins"] != tenSC.String() {
+		t.Fatal("expected pending balance of 10 SC, got", balanceResp.Metadata)
+	}
+
+	// spend the unconfirmed output
+	fee := stypes.SiacoinPrecision
+	txn := stypes.Transaction{
+		SiacoinInputs: []stypes.SiacoinInput{{
+			ParentID:         parentID,
+			UnlockConditions: uc,
+		}},
+		SiacoinOutputs: []stypes.SiacoinOutput{{
+			UnlockHash: stypes.UnlockHash{},
+			Value:      tenSC.Sub(fee),
+		}},
+		MinerFees: []stypes.Currency{fee},
+		TransactionSignatures: []stypes.TransactionSignature{{
+			ParentID:      crypto.Hash(parentID),
+			CoveredFields: stypes.CoveredFields{WholeTransaction: true},
+		}},
+	}
+	sig := crypto.SignHash(txn.SigHash(0, n.ConsensusSet.Height()), sk)
+	txn.TransactionSignatures[0].Signature = sig[:]
+	if err := n.TransactionPool.AcceptTransactionSet([]stypes.Transaction{txn}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the coin should no longer be reported
+	if resp := coins(true); len(resp.Coins) != 0 {
+		t.Fatal("spent coin should not be reported", resp.Coins)
+	}
+
+	// the input should be marked as unconfirmed, and the parents returned
+	resp, rerr := rs.MempoolTransaction(ctx, &rtypes.MempoolTransactionRequest{
+		NetworkIdentifier: ni,
+		TransactionIdentifier: &rtypes.TransactionIdentifier{
+			Hash: txn.ID().String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	input := resp.Transaction.Operations[0]
+	if input.Type != opTypeInput || input.Amount.Value != "-"+tenSC.String() {
+		t.Fatal("wrong input operation:", input)
+	} else if input.Metadata["unconfirmed"] != true {
+		t.Fatal("input should be marked as unconfirmed")
+	}
+	rparents, ok := resp.Metadata["unconfirmed_parents"].([]*rtypes.Transaction)
+	if !ok || len(rparents) != len(parents) {
+		t.Fatalf("expected %v parents, got %v", len(parents), resp.Metadata["unconfirmed_parents"])
+	}
+	for i := range parents {
+		if rparents[i].TransactionIdentifier.Hash != parents[i].ID().String() {
+			t.Fatal("parent mismatch")
+		}
+	}
+
+	// the first parent should have no parents of its own
+	resp, rerr = rs.MempoolTransaction(ctx, &rtypes.MempoolTransactionRequest{
+		NetworkIdentifier: ni,
+		TransactionIdentifier: &rtypes.TransactionIdentifier{
+			Hash: parents[0].ID().String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	} else if resp.Metadata != nil {
+		t.Fatal("first parent should not have parents:", resp.Metadata)
+	}
+}
+
+func TestSubmissionTracking(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	// mine enough to get spendable coins
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay; i++ {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	// fund returns the ID of a new confirmed 10 SC output controlled by sk
+	sk, pk := crypto.GenerateKeyPair()
+	uc := standardUnlockConditions(pk[:])
+	tenSC := stypes.SiacoinPrecision.Mul64(10)
+	fund := func() stypes.SiacoinOutputID {
+		t.Helper()
+		txns, err := n.Wallet.SendSiacoins(tenSC, uc.UnlockHash())
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+		for _, txn := range txns {
+			for i, sco := range txn.SiacoinOutputs {
+				if sco.UnlockHash == uc.UnlockHash() {
+					return txn.SiacoinOutputID(uint64(i))
+				}
+			}
+		}
+		t.Fatal("no output created")
+		return stypes.SiacoinOutputID{}
+	}
+	// spend returns a signed transaction sending the output, minus a 1 SC
+	// fee, to dest
+	fee := stypes.SiacoinPrecision
+	spendValue := func(id stypes.SiacoinOutputID, value stypes.Currency, dest stypes.UnlockHash) stypes.Transaction {
+		txn := stypes.Transaction{
+			SiacoinInputs: []stypes.SiacoinInput{{
+				ParentID:         id,
+				UnlockConditions: uc,
+			}},
+			SiacoinOutputs: []stypes.SiacoinOutput{{
+				UnlockHash: dest,
+				Value:      value.Sub(fee),
+			}},
+			MinerFees: []stypes.Currency{fee},
+			TransactionSignatures: []stypes.TransactionSignature{{
+				ParentID:      crypto.Hash(id),
+				CoveredFields: stypes.CoveredFields{WholeTransaction: true},
+			}},
+		}
+		sig := crypto.SignHash(txn.SigHash(0, n.ConsensusSet.Height()), sk)
+		txn.TransactionSignatures[0].Signature = sig[:]
+		return txn
+	}
+	spend := func(id stypes.SiacoinOutputID, dest stypes.UnlockHash) stypes.Transaction {
+		return spendValue(id, tenSC, dest)
+	}
+	ctx := context.Background()
+	submit := func(txn stypes.Transaction, parents ...stypes.Transaction) {
+		t.Helper()
+		_, rerr := rs.ConstructionSubmit(ctx, &rtypes.ConstructionSubmitRequest{
+			NetworkIdentifier: ni,
+			SignedTransaction: base64.StdEncoding.EncodeToString(encoding.Marshal(constructionTxn{
+				Transaction:  txn,
+				InputParents: []stypes.SiacoinOutput{{UnlockHash: uc.UnlockHash(), Value: tenSC}},
+				Parents:      parents,
+			})),
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	status := func(txn stypes.Transaction) *ConstructionStatusResponse {
+		t.Helper()
+		resp, rerr := rs.ConstructionStatus(ctx, &ConstructionStatusRequest{
+			NetworkIdentifier: ni,
+			TransactionIdentifier: &rtypes.TransactionIdentifier{
+				Hash: txn.ID().String(),
+			},
+		})
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		return resp
+	}
+	inPool := func(txn stypes.Transaction) bool {
+		_, _, ok := n.TransactionPool.Transaction(txn.ID())
+		return ok
+	}
+
+	// submit a transaction
+	txn := spend(fund(), stypes.UnlockHash{})
+	if _, rerr := rs.ConstructionStatus(ctx, &ConstructionStatusRequest{
+		NetworkIdentifier: ni,
+		TransactionIdentifier: &rtypes.TransactionIdentifier{
+			Hash: txn.ID().String(),
+		},
+	}); rerr != errUnknownTxn {
+		t.Fatal("expected unknown transaction error, got", rerr)
+	}
+	submit(txn)
+	if resp := status(txn); resp.Status != submissionPending || resp.BlockIdentifier != nil {
+		t.Fatal("expected pending transaction, got", resp)
+	}
+
+	// if the transaction is evicted, it should be rebroadcast
+	n.TransactionPool.PurgeTransactionPool()
+	if inPool(txn) {
+		t.Fatal("transaction should have been purged")
+	}
+	rs.rebroadcast()
+	if !inPool(txn) {
+		t.Fatal("transaction should have been rebroadcast")
+	}
+
+	// mine the transaction
+	b, err := n.Miner.AddBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := status(txn); resp.Status != submissionConfirmed {
+		t.Fatal("expected confirmed transaction, got", resp)
+	} else if resp.BlockIdentifier.Hash != b.ID().String() {
+		t.Fatal("wrong confirming block", resp.BlockIdentifier)
+	}
+
+	// submit a transaction, then confirm a conflicting transaction
+	id := fund()
+	txn = spend(id, stypes.UnlockHash{})
+	conflict := spend(id, stypes.UnlockHash{1})
+	submit(txn)
+	n.TransactionPool.PurgeTransactionPool()
+	if err := n.TransactionPool.AcceptTransactionSet([]stypes.Transaction{conflict}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := status(txn); resp.Status != submissionPending {
+		t.Fatal("expected pending transaction, got", resp)
+	}
+	if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := status(txn); resp.Status != submissionDropped || resp.BlockIdentifier != nil {
+		t.Fatal("expected dropped transaction, got", resp)
+	}
+	rs.rebroadcast()
+	if inPool(txn) {
+		t.Fatal("dropped transaction should not be rebroadcast")
+	}
+	unknown := func(txn stypes.Transaction) bool {
+		_, rerr := rs.ConstructionStatus(ctx, &ConstructionStatusRequest{
+			NetworkIdentifier: ni,
+			TransactionIdentifier: &rtypes.TransactionIdentifier{
+				Hash: txn.ID().String(),
+			},
+		})
+		return rerr == errUnknownTxn
+	}
+	if resp := status(txn); resp.Status != submissionDropped {
+		t.Fatal("dropped transaction should be retained, got", resp)
+	}
+	dropped := txn
+
+	// submit a transaction along with its unconfirmed parent
+	parent := spend(fund(), uc.UnlockHash())
+	child := spendValue(parent.SiacoinOutputID(0), tenSC.Sub(fee), stypes.UnlockHash{})
+	submit(child, parent)
+	if !inPool(parent) || !inPool(child) {
+		t.Fatal("transaction set should have been accepted")
+	}
+	// both transactions should be rebroadcast
+	n.TransactionPool.PurgeTransactionPool()
+	rs.rebroadcast()
+	if !inPool(parent) || !inPool(child) {
+		t.Fatal("transaction set should have been rebroadcast")
+	}
+	if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := status(child); resp.Status != submissionConfirmed {
+		t.Fatal("expected confirmed transaction, got", resp)
+	}
+	confirmed := child
+
+	// parents that are already in the pool should be attached automatically
+	parent = spend(fund(), uc.UnlockHash())
+	child = spendValue(parent.SiacoinOutputID(0), tenSC.Sub(fee), stypes.UnlockHash{})
+	if err := n.TransactionPool.AcceptTransactionSet([]stypes.Transaction{parent}); err != nil {
+		t.Fatal(err)
+	}
+	submit(child)
+	n.TransactionPool.PurgeTransactionPool()
+	rs.rebroadcast()
+	if !inPool(parent) || !inPool(child) {
+		t.Fatal("transaction set should have been rebroadcast")
+	}
+
+	// confirmed and dropped transactions should be deleted once they are
+	// buried deeper than the prune depth
+	rs.pruneDepth = 1
+	rs.rebroadcast()
+	if resp := status(confirmed); resp.Status != submissionConfirmed {
+		t.Fatal("expected confirmed transaction, got", resp)
+	}
+	if _, err := n.Miner.AddBlock(); err != nil {
+		t.Fatal(err)
+	}
+	rs.rebroadcast()
+	if !unknown(confirmed) {
+		t.Fatal("confirmed transaction should have been deleted")
+	} else if !unknown(dropped) {
+		t.Fatal("dropped transaction should have been deleted")
+	} else if resp := status(child); resp.Status != submissionConfirmed {
+		t.Fatal("expected confirmed transaction, got", resp)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, test := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"0.1.0", "0.1.0", 0},
+		{"0.1", "0.1.0", 0},
+		{"0.1.0", "0.2.0", -1},
+		{"0.10.0", "0.9.1", 1},
+		{"1.0.0", "0.99.99", 1},
+	} {
+		if cmp, err := compareVersions(test.a, test.b); err != nil || cmp != test.cmp {
+			t.Errorf("compareVersions(%q, %q): expected %v, got %v (%v)", test.a, test.b, test.cmp, cmp, err)
+		}
+	}
+	if _, err := compareVersions("0.1.x", "0.1.0"); err == nil {
+		t.Error("expected invalid version to be rejected")
+	}
+
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := badger.Open(badger.DefaultOptions(testDir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	getVersion := func() (version string) {
+		t.Helper()
+		err := db.View(func(txn *badger.Txn) error {
+			h := &txnHelper{txn: txn}
+			version = h.getVersion()
+			return h.err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	putVersion := func(version string) {
+		t.Helper()
+		err := db.Update(func(txn *badger.Txn) error {
+			h := &txnHelper{txn: txn}
+			h.putVersion(version)
+			return h.err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an empty database should be initialized
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	} else if v := getVersion(); v != dbVersion {
+		t.Fatalf("expected version %v, got %v", dbVersion, v)
+	}
+
+	// newer databases, and databases without a migration path, should be
+	// rejected
+	putVersion("99.0.0")
+	if err := migrateDB(db); err == nil {
+		t.Fatal("expected newer database to be rejected")
+	}
+	putVersion("0.0.1")
+	if err := migrateDB(db); err == nil {
+		t.Fatal("expected database without migration to be rejected")
+	}
+
+	// a database created with the original schema (version 0.1.0), which
+	// stored the UTXOs of each address in a single list, should be reindexed
+	addr := stypes.UnlockHash{1}
+	scoid := stypes.SiacoinOutputID{2}
+	bid := stypes.BlockID{3}
+	type blockInfoV1 struct {
+		Height         int64
+		DelayedOutputs []modules.DelayedSiacoinOutputDiff
+	}
+	fixture := map[string][]byte{
+		"version":           encoding.Marshal("0.1.0"),
+		"currentheight":     encoding.Marshal(stypes.BlockHeight(10)),
+		"currentblockid":    encoding.Marshal(bid),
+		"consensuschangeid": encoding.Marshal(modules.ConsensusChangeID{4}),
+		"voidbalance":       encoding.Marshal(stypes.NewCurrency64(5)),
+		string(append([]byte("utxos"), scoid[:]...)): encoding.Marshal(dbUTXO{Value: stypes.NewCurrency64(6)}),
+		string(append([]byte("addrs"), addr[:]...)):  append([]byte{1, 0, 0, 0, 0, 0, 0, 0}, scoid[:]...),
+		string(append([]byte("blocks"), bid[:]...)):  encoding.Marshal(blockInfoV1{Height: 10}),
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for k, v := range fixture {
+			if err := txn.Set([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	} else if v := getVersion(); v != dbVersion {
+		t.Fatalf("expected version %v, got %v", dbVersion, v)
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		h := &txnHelper{txn: txn}
+		if h.getCurrentHeight() != ^stypes.BlockHeight(0) || h.getCurrentBlockID() != stypes.GenesisID {
+			t.Error("expected reindexed database to start from the genesis block")
+		} else if h.getConsensusChangeID() != modules.ConsensusChangeBeginning {
+			t.Error("expected reindexed database to resubscribe from the beginning")
+		} else if !h.getVoidBalance().IsZero() {
+			t.Error("expected reindexed database to reset the void balance")
+		}
+		if h.has(keyUTXO(scoid)) || h.has(append([]byte("addrs"), addr[:]...)) || h.has(keyBlockID(bid)) {
+			t.Error("expected version 0.1.0 database to be reindexed")
+		}
+		return h.err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrations should be applied in order
+	defer func(old []migration) { migrations = old }(migrations)
+	var applied []string
+	record := func(db *badger.DB) error {
+		applied = append(applied, getVersion())
+		return db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("foo"), []byte("bar"))
+		})
+	}
+	putVersion("0.0.1")
+	migrations = []migration{
+		{from: "0.0.1", to: "0.0.2", apply: record},
+		{from: "0.0.2", to: dbVersion, apply: record},
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(applied, []string{"0.0.1", "0.0.2"}) {
+		t.Fatal("migrations were not applied in order:", applied)
+	} else if v := getVersion(); v != dbVersion {
+		t.Fatalf("expected version %v, got %v", dbVersion, v)
+	}
+
+	// if any migration requires a reindex, the database should be reindexed
+	// without applying the others
+	applied = nil
+	putVersion("0.0.1")
+	migrations = []migration{
+		{from: "0.0.1", to: "0.0.2", apply: record},
+		{from: "0.0.2", to: dbVersion},
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 0 {
+		t.Fatal("migration should not be applied before a reindex")
+	} else if v := getVersion(); v != dbVersion {
+		t.Fatalf("expected version %v, got %v", dbVersion, v)
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("foo"))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Fatal("expected database to be reindexed, got", err)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	testDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, errCh := node.New(node.Miner(testDir), time.Time{})
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeDefaultWallet)
+	if _, err = n.Wallet.Encrypt(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Wallet.Unlock(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	ni := &rtypes.NetworkIdentifier{
+		Blockchain: "Sia",
+		Network:    "Testnet",
+	}
+	rs, err := New(ni, n.Gateway, n.ConsensusSet, n.TransactionPool, testDir, DefaultPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	void := stypes.UnlockHash{1, 2, 3}
+	sendAndMine := func() {
+		t.Helper()
+		if _, err := n.Wallet.SendSiacoins(stypes.SiacoinPrecision, void); err != nil {
+			t.Fatal(err)
+		} else if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := stypes.BlockHeight(0); i <= stypes.MaturityDelay; i++ {
+		if _, err := n.Miner.AddBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendAndMine()
+
+	reindexDir, err := ioutil.TempDir("", "rosetta-sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbDir := filepath.Join(reindexDir, "db")
+	update := func(fn func(h *txnHelper)) {
+		t.Helper()
+		db, err := openDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		err = db.Update(func(txn *badger.Txn) error {
+			h := &txnHelper{txn: txn}
+			fn(h)
+			return h.err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// markDB adds a key to the reindexed database, which survives a reindex
+	// only if the database is not wiped
+	markDB := func() {
+		update(func(h *txnHelper) { h.putBytes([]byte("foo"), nil) })
+	}
+	// checkReindexed checks that the reindexed database matches the database
+	// of rs, and reports whether it contains the key added by markDB
+	checkReindexed := func() (marked bool) {
+		t.Helper()
+		var bid stypes.BlockID
+		var height stypes.BlockHeight
+		var totals dbAddressTotals
+		var bal dbBalance
+		err := rs.dbView(func(h *txnHelper) {
+			bid, height = h.getCurrentBlockID(), h.getCurrentHeight()
+			totals, bal = h.getAddressTotals(void), h.getBalanceAt(void, height)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(func(h *txnHelper) {
+			if h.getCurrentBlockID() != bid || h.getCurrentHeight() != height {
+				t.Error("reindexed database has a different tip")
+			} else if t2 := h.getAddressTotals(void); t2.SiacoinOutputs != totals.SiacoinOutputs || !t2.Siacoins.Equals(totals.Siacoins) {
+				t.Errorf("reindexed database has different totals: expected %v, got %v", totals, t2)
+			} else if b2 := h.getBalanceAt(void, height); !b2.Siacoins.Equals(bal.Siacoins) {
+				t.Errorf("reindexed database has different balance: expected %v, got %v", bal.Siacoins, b2.Siacoins)
+			} else if h.has(keyReindexing) {
+				t.Error("reindexed database is still marked as incomplete")
+			}
+			marked = h.has([]byte("foo"))
+		})
+		return
+	}
+
+	// an interrupted reindex should leave the database marked as incomplete
+	cancel := make(chan struct{})
+	close(cancel)
+	if err := Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, cancel); err == nil {
+		t.Fatal("expected interrupted reindex to fail")
+	}
+	update(func(h *txnHelper) {
+		if !h.has(keyReindexing) {
+			t.Error("expected interrupted database to be marked as incomplete")
+		}
+	})
+
+	// the reindex should then resume, rather than wiping the database
+	markDB()
+	if err := Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, nil); err != nil {
+		t.Fatal(err)
+	} else if !checkReindexed() {
+		t.Fatal("expected interrupted reindex to be resumed")
+	}
+
+	// resuming should pick up where the previous reindex left off
+	update(func(h *txnHelper) { h.putBytes(keyReindexing, nil) })
+	sendAndMine()
+	if err := Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, nil); err != nil {
+		t.Fatal(err)
+	} else if !checkReindexed() {
+		t.Fatal("expected interrupted reindex to be resumed")
+	}
+
+	// a database that is in use should be left untouched
+	markDB()
+	db, err := openDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, nil)
+	db.Close()
+	if err == nil {
+		t.Fatal("expected reindex of locked database to fail")
+	} else if !checkReindexed() {
+		t.Fatal("expected locked database to be left untouched")
+	}
+
+	// a database that cannot be opened should be wiped and rebuilt
+	markDB()
+	if err := ioutil.WriteFile(filepath.Join(dbDir, "MANIFEST"), []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := openDB(dbDir); err == nil {
+		t.Fatal("expected corrupted database to fail to open")
+	}
+	if err := Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, nil); err != nil {
+		t.Fatal(err)
+	} else if checkReindexed() {
+		t.Fatal("expected corrupted database to be wiped")
+	}
+
+	// a complete database should be wiped and rebuilt
+	if err := Reindex(n.ConsensusSet, dbDir, DefaultPruneDepth, nil); err != nil {
+		t.Fatal(err)
+	} else if checkReindexed() {
+		t.Fatal("expected complete database to be wiped")
+	}
+}
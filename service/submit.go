@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/asserter"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+// rebroadcastInterval is how often pending submissions are rebroadcast.
+const rebroadcastInterval = 10 * time.Minute
+
+// Statuses of a submitted transaction.
+const (
+	submissionPending   = "pending"
+	submissionConfirmed = "confirmed"
+	submissionDropped   = "dropped"
+)
+
+// submissionStatus returns the status of a submitted transaction set. The set
+// is confirmed if its final transaction is in the best chain, and dropped if
+// one of its unconfirmed transactions spends an output that no longer exists,
+// i.e. an output that was spent by a conflicting transaction. Outputs created
+// by the transactions in uo are considered to exist.
+func submissionStatus(h *txnHelper, sub dbSubmission, uo unconfirmedOutputs) (string, *txnLocation) {
+	var loc txnLocation
+	if h.get(keyTxn(crypto.Hash(sub.Set[len(sub.Set)-1].ID())), &loc) {
+		return submissionConfirmed, &loc
+	}
+	created := newUnconfirmedOutputs(sub.Set)
+	for _, txn := range sub.Set {
+		if h.get(keyTxn(crypto.Hash(txn.ID())), new(txnLocation)) {
+			continue
+		}
+		for _, sci := range txn.SiacoinInputs {
+			_, inSet := created.siacoin[sci.ParentID]
+			_, inPool := uo.siacoin[sci.ParentID]
+			if !inSet && !inPool && !h.isUnspent(sci.UnlockConditions.UnlockHash(), sci.ParentID) {
+				return submissionDropped, nil
+			}
+		}
+		for _, sfi := range txn.SiafundInputs {
+			_, inSet := created.siafund[sfi.ParentID]
+			_, inPool := uo.siafund[sfi.ParentID]
+			if !inSet && !inPool && !h.isSiafundUnspent(sfi.UnlockConditions.UnlockHash(), sfi.ParentID) {
+				return submissionDropped, nil
+			}
+		}
+	}
+	return submissionPending, nil
+}
+
+// rebroadcast resubmits each pending transaction set to the transaction pool,
+// or, if the pool already contains it, broadcasts it to peers. Transaction sets
+// that were confirmed, or first seen to be dropped, more than pruneDepth blocks
+// ago are deleted.
+func (rs *RosettaService) rebroadcast() {
+	uo := rs.unconfirmedOutputs()
+	var sets [][]stypes.Transaction
+	err := rs.dbUpdate(func(h *txnHelper) {
+		height := h.getCurrentHeight()
+		for _, sub := range h.getSubmissions() {
+			txid := crypto.Hash(sub.Set[len(sub.Set)-1].ID())
+			switch status, loc := submissionStatus(h, sub, uo); status {
+			case submissionPending:
+				if sub.Dropped {
+					sub.Dropped, sub.DroppedHeight = false, 0
+					h.putSubmission(txid, sub)
+				}
+				sets = append(sets, sub.Set)
+			case submissionConfirmed:
+				if height-loc.Height > rs.pruneDepth {
+					h.deleteSubmission(txid)
+				}
+			case submissionDropped:
+				if !sub.Dropped {
+					sub.Dropped, sub.DroppedHeight = true, height
+					h.putSubmission(txid, sub)
+				} else if height-sub.DroppedHeight > rs.pruneDepth {
+					h.deleteSubmission(txid)
+				}
+			}
+		}
+	})
+	if err != nil {
+		log.Println("WARN: failed to update submitted transactions:", err)
+		return
+	}
+	for _, set := range sets {
+		err := rs.tp.AcceptTransactionSet(set)
+		if err == modules.ErrDuplicateTransactionSet {
+			rs.tp.Broadcast(set)
+		} else if err != nil {
+			log.Printf("WARN: failed to rebroadcast transaction %v: %v", set[len(set)-1].ID(), err)
+		}
+	}
+}
+
+func (rs *RosettaService) rebroadcastLoop() {
+	defer rs.bg.Done()
+	for {
+		rs.rebroadcast()
+		select {
+		case <-rs.closed:
+			return
+		case <-time.After(rebroadcastInterval):
+		}
+	}
+}
+
+// ConstructionStatusRequest is the request type for the /construction/status
+// endpoint.
+type ConstructionStatusRequest struct {
+	NetworkIdentifier     *rtypes.NetworkIdentifier     `json:"network_identifier"`
+	TransactionIdentifier *rtypes.TransactionIdentifier `json:"transaction_identifier"`
+}
+
+func (req *ConstructionStatusRequest) network() *rtypes.NetworkIdentifier {
+	return req.NetworkIdentifier
+}
+
+func (req *ConstructionStatusRequest) validate() error {
+	return asserter.TransactionIdentifier(req.TransactionIdentifier)
+}
+
+// ConstructionStatusResponse is the response type for the /construction/status
+// endpoint. BlockIdentifier is only set if the transaction is confirmed.
+type ConstructionStatusResponse struct {
+	Status          string                  `json:"status"`
+	SubmittedAt     int64                   `json:"submitted_at"`
+	BlockIdentifier *rtypes.BlockIdentifier `json:"block_identifier,omitempty"`
+}
+
+// ConstructionStatus implements the /construction/status endpoint. This
+// endpoint is not part of the Rosetta specification; it reports whether a
+// transaction submitted via /construction/submit is pending, confirmed, or
+// dropped (i.e. invalidated by a conflicting transaction). Pending
+// transactions are periodically rebroadcast until they are confirmed or
+// dropped. Transactions that were confirmed, or dropped, more than pruneDepth
+// blocks ago are eventually forgotten, after which they are reported as
+// unknown.
+func (rs *RosettaService) ConstructionStatus(ctx context.Context, request *ConstructionStatusRequest) (*ConstructionStatusResponse, *rtypes.Error) {
+	if rs.offline() {
+		return nil, errOffline
+	}
+	var txid crypto.Hash
+	if err := txid.LoadString(request.TransactionIdentifier.Hash); err != nil {
+		return nil, errInvalidTxnID(err)
+	}
+	uo := rs.unconfirmedOutputs()
+	var resp *ConstructionStatusResponse
+	err := rs.dbView(func(h *txnHelper) {
+		sub, ok := h.getSubmission(txid)
+		if !ok {
+			return
+		}
+		status, loc := submissionStatus(h, sub, uo)
+		resp = &ConstructionStatusResponse{
+			Status:      status,
+			SubmittedAt: int64(sub.Timestamp) * 1000,
+		}
+		if loc != nil {
+			resp.BlockIdentifier = &rtypes.BlockIdentifier{
+				Index: int64(loc.Height),
+				Hash:  loc.BlockID.String(),
+			}
+		}
+	})
+	if err != nil {
+		return nil, errDatabase(err)
+	} else if resp == nil {
+		return nil, errUnknownTxn
+	}
+	return resp, nil
+}
+
+// StatusAPIController serves the /construction/status endpoint.
+type StatusAPIController struct {
+	rs       *RosettaService
+	asserter *asserter.Asserter
+}
+
+// NewStatusAPIController returns a router for the /construction/status
+// endpoint.
+func NewStatusAPIController(rs *RosettaService, a *asserter.Asserter) server.Router {
+	return &StatusAPIController{
+		rs:       rs,
+		asserter: a,
+	}
+}
+
+// Routes implements server.Router.
+func (c *StatusAPIController) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "ConstructionStatus",
+			Method:      http.MethodPost,
+			Pattern:     "/construction/status",
+			HandlerFunc: c.ConstructionStatus,
+		},
+	}
+}
+
+// ConstructionStatus handles the /construction/status endpoint.
+func (c *StatusAPIController) ConstructionStatus(w http.ResponseWriter, r *http.Request) {
+	var request ConstructionStatusRequest
+	serveEndpoint(w, r, c.asserter, &request, func() (interface{}, *rtypes.Error) {
+		return c.rs.ConstructionStatus(r.Context(), &request)
+	})
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	stypes "gitlab.com/NebulousLabs/Sia/types"
+)
+
+// constructionOp is a validated operation of a construction request.
+type constructionOp struct {
+	*rtypes.Operation
+	Siafund bool
+	Value   stypes.Currency
+	Address stypes.UnlockHash // not set for Fee operations
+
+	// input fields
+	ParentID         crypto.Hash
+	UnlockConditions stypes.UnlockConditions
+	KeyIndices       []uint64
+	ClaimAddress     stypes.UnlockHash
+}
+
+// parseCurrency strictly parses a non-negative base-10 integer.
+func parseCurrency(s string) (stypes.Currency, error) {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok || i.Sign() < 0 || strings.HasPrefix(s, "+") {
+		return stypes.Currency{}, fmt.Errorf("invalid value %q", s)
+	}
+	return stypes.NewCurrency(i), nil
+}
+
+// validateConstructionOp validates the shape of a single operation. If final
+// is false, inputs are permitted to omit their unlock conditions, in which case
+// placeholder standard unlock conditions are used.
+func validateConstructionOp(op *rtypes.Operation, final bool) (constructionOp, *rtypes.Error) {
+	switch {
+	case op == nil:
+		return constructionOp{}, errInvalidOperation(errors.New("operation is null"))
+	case op.Account == nil:
+		return constructionOp{}, errInvalidOperation(errors.New("operation has no account"))
+	case op.Amount == nil:
+		return constructionOp{}, errInvalidOperation(errors.New("operation has no amount"))
+	case op.Amount.Currency == nil:
+		return constructionOp{}, errUnsupportedCurrency(errors.New("amount has no currency"))
+	}
+	cop := constructionOp{Operation: op}
+	switch c := op.Amount.Currency; {
+	case c.Symbol == currencySiacoin.Symbol && c.Decimals == currencySiacoin.Decimals:
+	case c.Symbol == currencySiafund.Symbol && c.Decimals == currencySiafund.Decimals:
+		cop.Siafund = true
+	default:
+		return constructionOp{}, errUnsupportedCurrency(fmt.Errorf("unsupported currency %v (%v decimals)", c.Symbol, c.Decimals))
+	}
+	negative := strings.HasPrefix(op.Amount.Value, "-")
+	value, err := parseCurrency(strings.TrimPrefix(op.Amount.Value, "-"))
+	if err != nil {
+		return constructionOp{}, errInvalidAmount(err)
+	}
+	cop.Value = value
+
+	switch op.Type {
+	case opTypeFee:
+		if negative || cop.Siafund {
+			return constructionOp{}, errInvalidOperation(errors.New("fee must be a positive siacoin amount"))
+		} else if op.Account.Address != minerFeesAddress {
+			return constructionOp{}, errInvalidOperation(fmt.Errorf("fee must be paid to the %v account", minerFeesAddress))
+		}
+		return cop, nil
+	case opTypeInput:
+		if !negative {
+			return constructionOp{}, errInvalidOperation(errors.New("input amount must be negative"))
+		}
+	case opTypeOutput:
+		if negative {
+			return constructionOp{}, errInvalidOperation(errors.New("output amount must not be negative"))
+		}
+	default:
+		return constructionOp{}, errInvalidOperation(fmt.Errorf("operation type %q cannot be constructed (supported types: %v, %v, %v)", op.Type, opTypeInput, opTypeOutput, opTypeFee))
+	}
+	if err := cop.Address.LoadString(op.Account.Address); err != nil {
+		return constructionOp{}, errInvalidAddress(err)
+	}
+	if op.Type == opTypeOutput {
+		if op.CoinChange != nil && op.CoinChange.CoinAction != rtypes.CoinCreated {
+			return constructionOp{}, errInvalidOperation(fmt.Errorf("output coin action must be %q", rtypes.CoinCreated))
+		}
+		return cop, nil
+	}
+
+	// validate input fields
+	if op.CoinChange == nil || op.CoinChange.CoinIdentifier == nil {
+		return constructionOp{}, errInvalidOperation(errors.New("input has no coin identifier"))
+	} else if op.CoinChange.CoinAction != rtypes.CoinSpent {
+		return constructionOp{}, errInvalidOperation(fmt.Errorf("input coin action must be %q", rtypes.CoinSpent))
+	} else if err := cop.ParentID.LoadString(op.CoinChange.CoinIdentifier.Identifier); err != nil {
+		return constructionOp{}, errInvalidOperation(fmt.Errorf("invalid coin identifier: %v", err))
+	}
+	_, hasKey := op.Metadata["public_key"]
+	_, hasUC := op.Metadata["unlock_conditions"]
+	if !final && !hasKey && !hasUC {
+		cop.UnlockConditions = standardUnlockConditions(make([]byte, crypto.PublicKeySize))
+		cop.KeyIndices = []uint64{0}
+	} else {
+		cop.UnlockConditions, cop.KeyIndices, err = inputUnlockConditions(op.Metadata)
+		if err != nil {
+			return constructionOp{}, errInvalidUnlockConditions(err)
+		} else if cop.UnlockConditions.UnlockHash() != cop.Address {
+			return constructionOp{}, errInvalidUnlockConditions(errors.New("unlock conditions do not match address"))
+		}
+	}
+	cop.ClaimAddress = cop.Address
+	var claimAddr string
+	if ok, err := decodeMetadata(op.Metadata, "claim_address", &claimAddr); err != nil {
+		return constructionOp{}, errInvalidAddress(err)
+	} else if ok && !cop.Siafund {
+		return constructionOp{}, errInvalidOperation(errors.New("claim_address is only valid for siafund inputs"))
+	} else if ok {
+		if err := cop.ClaimAddress.LoadString(claimAddr); err != nil {
+			return constructionOp{}, errInvalidAddress(err)
+		}
+	}
+	return cop, nil
+}
+
+// checkBalance checks that the inputs of ops cover their outputs and fees. If
+// exact is true, the inputs must equal the outputs and fees, as required by
+// consensus; otherwise, the excess is assumed to be the (not yet specified)
+// fee. Siafunds cannot be used to pay fees, so siafund inputs must always equal
+// siafund outputs.
+func checkBalance(ops []constructionOp, exact bool) *rtypes.Error {
+	var scIn, scOut, sfIn, sfOut stypes.Currency
+	for _, op := range ops {
+		switch {
+		case op.Type == opTypeInput && op.Siafund:
+			sfIn = sfIn.Add(op.Value)
+		case op.Type == opTypeInput:
+			scIn = scIn.Add(op.Value)
+		case op.Siafund:
+			sfOut = sfOut.Add(op.Value)
+		default:
+			scOut = scOut.Add(op.Value)
+		}
+	}
+	if cmp := scIn.Cmp(scOut); cmp < 0 || (exact && cmp != 0) {
+		return errUnbalancedOperations(fmt.Errorf("siacoin inputs (%v H) must equal outputs plus fees (%v H)", scIn, scOut))
+	} else if !sfIn.Equals(sfOut) {
+		return errUnbalancedOperations(fmt.Errorf("siafund inputs (%v) must equal outputs (%v)", sfIn, sfOut))
+	}
+	return nil
+}
+
+// validateConstructionOps validates the operations of a construction request.
+// If final is true, the operations must fully specify the transaction, i.e. they
+// must include the unlock conditions of each input and the transaction fee.
+// Errors concerning a particular operation include its index in their details.
+func validateConstructionOps(ops []*rtypes.Operation, final bool) ([]constructionOp, *rtypes.Error) {
+	if len(ops) == 0 {
+		return nil, errInvalidOperation(errors.New("no operations specified"))
+	}
+	cops := make([]constructionOp, len(ops))
+	for i, op := range ops {
+		cop, err := validateConstructionOp(op, final)
+		if err != nil {
+			err.Details["operation_index"] = i
+			return nil, err
+		}
+		cops[i] = cop
+	}
+	if err := checkBalance(cops, final); err != nil {
+		return nil, err
+	}
+	return cops, nil
+}